@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the api is versioned by path, everything lives under this prefix
+const apiPrefix = "/api/v1/"
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func apiFail(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	writeJSON(w, code, apiError{Error: fmt.Sprintf(format, args...)})
+}
+
+// ServeAPI routes every request under /api/v1/
+func ServeAPI(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case parts[0] == "network" && len(parts) == 1:
+		apiNetwork(w, r)
+	case parts[0] == "nodes" && len(parts) == 1:
+		apiNodes(w, r)
+	case parts[0] == "nodes" && len(parts) == 2:
+		apiNode(w, r, parts[1])
+	case parts[0] == "nodes" && len(parts) == 3:
+		apiNodeAction(w, r, parts[1], parts[2])
+	case parts[0] == "run" && len(parts) == 1:
+		apiRun(w, r)
+	case parts[0] == "files" && len(parts) == 1:
+		apiFiles(w, r)
+	case parts[0] == "files" && len(parts) == 2:
+		apiFile(w, r, parts[1])
+	case parts[0] == "results" && len(parts) == 1:
+		apiResults(w, r)
+	case parts[0] == "stats" && len(parts) == 1:
+		apiStats(w, r)
+	case parts[0] == "shutdown" && len(parts) == 1:
+		if r.Method != "POST" {
+			apiFail(w, http.StatusMethodNotAllowed, "shutdown must be POSTed")
+			return
+		}
+		writeJSON(w, http.StatusOK, struct{}{})
+		go Shutdown(ExitOK)
+	default:
+		apiFail(w, http.StatusNotFound, "no such endpoint: %s", r.URL.Path)
+	}
+}
+
+// NodeSummary is a node as listed by the api
+type NodeSummary struct {
+	Node  int    `json:"node"`
+	Peer  string `json:"peer"`
+	State string `json:"state"`
+	Peers int    `json:"peers"`
+}
+
+func nodeSummaries(idexlist []int) []NodeSummary {
+	out := make([]NodeSummary, 0, len(idexlist))
+	for _, i := range idexlist {
+		ns := NodeSummary{Node: i, Peer: configs[i].Identity.PeerID, State: nodeState(i)}
+		if c := controller(i); c != nil {
+			ns.Peers = c.NumPeers()
+		}
+		out = append(out, ns)
+	}
+	return out
+}
+
+func allNodes() []int {
+	out := make([]int, numNodes())
+	for i := range out {
+		out[i] = i
+	}
+	return out
+}
+
+// apiRange parses a node range, with or without its brackets
+func apiRange(s string) ([]int, error) {
+	if strings.Contains(s, "-") && s[0] != '[' {
+		s = "[" + s + "]"
+	}
+	idexlist, err := ParseRange(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range idexlist {
+		if i < 0 || i >= numNodes() {
+			return nil, fmt.Errorf("index %d out of range", i)
+		}
+	}
+	return idexlist, nil
+}
+
+type networkInfo struct {
+	Setup  *RunSetup     `json:"setup"`
+	Nodes  []NodeSummary `json:"nodes"`
+	Output string        `json:"output,omitempty"`
+}
+
+// apiNetwork describes the network, or with a POSTed scenario in the
+// format of a -f script creates it and runs the scenario's commands
+func apiNetwork(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		networkLk.RLock()
+		defer networkLk.RUnlock()
+		writeJSON(w, http.StatusOK, networkInfo{Setup: CurrentSetup(), Nodes: nodeSummaries(allNodes())})
+	case "POST":
+		networkLk.Lock()
+		if networkUp {
+			networkLk.Unlock()
+			apiFail(w, http.StatusConflict, "%s", ErrNetworkUp)
+			return
+		}
+
+		scan, err := ParseScenario(NewScriptScanner("api", r.Body), new(testConfig))
+		if err != nil {
+			resetNetwork()
+			networkLk.Unlock()
+			apiFail(w, http.StatusBadRequest, "bad scenario: %s", err)
+			return
+		}
+		err = startNetwork(masterCtx)
+		networkLk.Unlock()
+		if err != nil {
+			apiFail(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+
+		// the network is up, so its commands run without the lock
+
+		var out bytes.Buffer
+		if scan != nil && !RunScript(&out, scan, false) {
+			if endsRun(scan.Text()) {
+				go Shutdown(ExitOK)
+			} else {
+				fmt.Fprintf(&out, "Scenario stopped at %s, the run goes on.\n", scan.Pos())
+			}
+		}
+		writeJSON(w, http.StatusCreated, networkInfo{
+			Setup:  CurrentSetup(),
+			Nodes:  nodeSummaries(allNodes()),
+			Output: out.String(),
+		})
+	default:
+		apiFail(w, http.StatusMethodNotAllowed, "network takes GET or POST")
+	}
+}
+
+func apiNodes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, nodeSummaries(allNodes()))
+}
+
+func apiNode(w http.ResponseWriter, r *http.Request, idx string) {
+	i, err := strconv.Atoi(idx)
+	if err != nil || i < 0 || i >= len(configs) {
+		apiFail(w, http.StatusNotFound, "no node %s", idx)
+		return
+	}
+	writeJSON(w, http.StatusOK, BuildNodeDetail(masterCtx, i))
+}
+
+// apiNodeAction starts or kills a range of nodes
+func apiNodeAction(w http.ResponseWriter, r *http.Request, rng, action string) {
+	if r.Method != "POST" {
+		apiFail(w, http.StatusMethodNotAllowed, "%s must be POSTed", action)
+		return
+	}
+	idexlist, err := apiRange(rng)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, "bad range: %s", err)
+		return
+	}
+
+	var out bytes.Buffer
+	switch action {
+	case "start":
+		StartNodes(&out, idexlist)
+	case "kill":
+		for _, i := range idexlist {
+			if nodeState(i) == "running" {
+				if _, err := runOnNode(i, []string{strconv.Itoa(i), "kill"}, false); err != nil {
+					fmt.Fprintf(&out, "ERROR: failed to kill node %d: %s\n", i, err)
+				}
+			}
+		}
+	default:
+		apiFail(w, http.StatusNotFound, "unknown node action '%s'", action)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Nodes  []NodeSummary `json:"nodes"`
+		Output string        `json:"output,omitempty"`
+	}{nodeSummaries(idexlist), out.String()})
+}
+
+type runRequest struct {
+	Nodes string `json:"nodes"`
+	Cmd   string `json:"cmd"`
+	Trace bool   `json:"trace"`
+}
+
+type runResult struct {
+	Node     int           `json:"node"`
+	Output   string        `json:"output"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// apiRun runs a command on every node in a range at once and waits
+// for all of them
+func apiRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiFail(w, http.StatusMethodNotAllowed, "run must be POSTed")
+		return
+	}
+	var req runRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiFail(w, http.StatusBadRequest, "bad request: %s", err)
+		return
+	}
+	idexlist, err := apiRange(req.Nodes)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, "bad range: %s", err)
+		return
+	}
+	args := strings.Fields(req.Cmd)
+	if len(args) == 0 {
+		apiFail(w, http.StatusBadRequest, "no command given")
+		return
+	}
+
+	results := make([]runResult, len(idexlist))
+	var wg sync.WaitGroup
+	for j, i := range idexlist {
+		wg.Add(1)
+		go func(j, i int) {
+			defer wg.Done()
+			defer RecoverPanic()
+			start := time.Now()
+			out, err := runOnNode(i, append([]string{req.Nodes}, args...), req.Trace)
+			results[j] = runResult{Node: i, Output: out, Duration: time.Since(start)}
+			if err != nil {
+				results[j].Error = err.Error()
+			}
+		}(j, i)
+	}
+	wg.Wait()
+	writeJSON(w, http.StatusOK, results)
+}
+
+type fileSummary struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Gen     string `json:"gen,omitempty"`
+	Seed    int64  `json:"seed,omitempty"`
+	Digest  string `json:"sha256,omitempty"`
+	Stream  bool   `json:"stream,omitempty"`
+	RootKey string `json:"root_key,omitempty"`
+	Chunker string `json:"chunker,omitempty"`
+	Chunks  int    `json:"chunks,omitempty"`
+	Blocks  int    `json:"blocks,omitempty"`
+}
+
+// summarizeFile describes a file, the caller must hold filesLk if
+// others can see it
+func summarizeFile(fi *FileInfo) fileSummary {
+	fs := fileSummary{Name: fi.Name, Size: fi.Size()}
+	if fi.Gen != nil {
+		fs.Gen = fi.Gen.String()
+		fs.Seed = fi.Seed
+		fs.Digest = fmt.Sprintf("%x", fi.Digest)
+	}
+	fs.Stream = fi.Stream || fi.Path != ""
+	if fi.RootKey != "" {
+		fs.RootKey = fi.RootKey.B58String()
+		fs.Chunker = fi.Chunker
+		fs.Chunks = fi.Chunks
+		fs.Blocks = fi.Blocks
+	}
+	return fs
+}
+
+// fileRequest creates a file, the size takes units ("4MB") and gen is
+// the rest of an '@f make' line: a generator, seed= and stream
+type fileRequest struct {
+	Name string `json:"name"`
+	Size string `json:"size"`
+	Gen  string `json:"gen"`
+}
+
+// apiFiles lists the files of the run, or creates one from a POSTed
+// name and size
+func apiFiles(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		filesLk.RLock()
+		var names []string
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		out := make([]fileSummary, 0, len(names))
+		for _, name := range names {
+			out = append(out, summarizeFile(files[name]))
+		}
+		filesLk.RUnlock()
+		writeJSON(w, http.StatusOK, out)
+	case "POST":
+		var req fileRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apiFail(w, http.StatusBadRequest, "bad request: %s", err)
+			return
+		}
+		if req.Name == "" {
+			apiFail(w, http.StatusBadRequest, "files need a name")
+			return
+		}
+		fi, err := MakeFile(req.Name, append([]string{req.Size}, strings.Fields(req.Gen)...))
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		fs := summarizeFile(fi)
+		putFile(fi)
+		Emit(&Event{Type: EvFileCreate, Node: -1, File: req.Name, Cmd: fi.MakeCmd()})
+		writeJSON(w, http.StatusCreated, fs)
+	default:
+		apiFail(w, http.StatusMethodNotAllowed, "files takes GET or POST")
+	}
+}
+
+func apiFile(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case "GET", "DELETE":
+		filesLk.Lock()
+		fi, ok := files[name]
+		var fs fileSummary
+		if ok {
+			fs = summarizeFile(fi)
+			if r.Method == "DELETE" {
+				delete(files, name)
+			}
+		}
+		filesLk.Unlock()
+		if !ok {
+			apiFail(w, http.StatusNotFound, "no file '%s'", name)
+			return
+		}
+		writeJSON(w, http.StatusOK, fs)
+	default:
+		apiFail(w, http.StatusMethodNotAllowed, "a file takes GET or DELETE")
+	}
+}
+
+// apiResults returns recorded results, optionally only those after
+// ?since=N (the count already fetched), for ?node= or ?command=
+func apiResults(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	since, _ := strconv.Atoi(q.Get("since"))
+	node := -1
+	if ns := q.Get("node"); ns != "" {
+		n, err := strconv.Atoi(ns)
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, "bad node: %s", err)
+			return
+		}
+		node = n
+	}
+	cmd := strings.ToLower(q.Get("command"))
+
+	rslock.Lock()
+	total := len(allResults)
+	out := make([]*Result, 0)
+	for j := since; j >= 0 && j < total; j++ {
+		res := allResults[j]
+		if (node < 0 || res.Node == node) && (cmd == "" || res.Command == cmd) {
+			out = append(out, res)
+		}
+	}
+	rslock.Unlock()
+
+	writeJSON(w, http.StatusOK, struct {
+		Total   int       `json:"total"`
+		Results []*Result `json:"results"`
+	}{total, out})
+}
+
+type commandStats struct {
+	All    *LatencySummary            `json:"all"`
+	Groups map[string]*LatencySummary `json:"groups,omitempty"`
+}
+
+// apiStats returns the latency summary of every command type, broken
+// down by node group like the stats command
+func apiStats(w http.ResponseWriter, r *http.Request) {
+	only := r.URL.Query()["command"]
+
+	rslock.Lock()
+	rs := make([]*Result, len(allResults))
+	copy(rs, allResults)
+	rslock.Unlock()
+
+	out := make(map[string]*commandStats)
+	for c, crs := range ResultsByCommand(rs) {
+		if len(only) > 0 && !containsString(only, c) {
+			continue
+		}
+		cs := &commandStats{All: Summarize(crs), Groups: make(map[string]*LatencySummary)}
+		for g, idx := range nodeGroups {
+			var grs []*Result
+			for _, res := range crs {
+				if inGroup(res.Node, idx) {
+					grs = append(grs, res)
+				}
+			}
+			if len(grs) > 0 {
+				cs.Groups[g] = Summarize(grs)
+			}
+		}
+		out[c] = cs
+	}
+	writeJSON(w, http.StatusOK, out)
+}
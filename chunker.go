@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	chunk "github.com/jbenet/go-ipfs/importer/chunk"
+	mdag "github.com/jbenet/go-ipfs/merkledag"
+	u "github.com/jbenet/go-ipfs/util"
+)
+
+// the chunker used by add when none is given
+const defaultChunker = "size-256KB"
+
+// ParseChunker builds a splitter from a chunker spec:
+//
+//	size-256KB              fixed size blocks
+//	rabin-8KB               content defined blocks averaging 8KB
+//	rabin-8KB-4KB-16KB      the same, bounded to between 4KB and 16KB
+func ParseChunker(spec string) (chunk.BlockSplitter, error) {
+	parts := strings.Split(spec, "-")
+	sizes := make([]int, 0, len(parts)-1)
+	for _, p := range parts[1:] {
+		n, err := ParseSize(p)
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("chunker sizes must be positive, got '%s'", p)
+		}
+		sizes = append(sizes, int(n))
+	}
+
+	switch {
+	case parts[0] == "size" && len(sizes) == 1:
+		return &chunk.SizeSplitter{Size: sizes[0]}, nil
+	case parts[0] == "rabin" && len(sizes) == 1:
+		return chunk.NewMaybeRabin(sizes[0]), nil
+	case parts[0] == "rabin" && len(sizes) == 3:
+		if sizes[1] > sizes[0] || sizes[0] > sizes[2] {
+			return nil, fmt.Errorf("rabin needs min <= avg <= max, got '%s'", spec)
+		}
+		mr := chunk.NewMaybeRabin(sizes[0])
+		mr.MinBlockSize = sizes[1]
+		mr.MaxBlockSize = sizes[2]
+		return mr, nil
+	}
+	return nil, fmt.Errorf("bad chunker '%s', want size-N, rabin-AVG or rabin-AVG-MIN-MAX", spec)
+}
+
+// parseAddOpts reads the options of add and addtree, returning the
+// chunker asked for and a splitter counting its chunks
+func parseAddOpts(opts []string) (string, *countingSplitter, error) {
+	chunker := defaultChunker
+	for _, opt := range opts {
+		if !strings.HasPrefix(opt, "chunker=") {
+			return "", nil, fmt.Errorf("unknown add option '%s'", opt)
+		}
+		chunker = strings.TrimPrefix(opt, "chunker=")
+	}
+	spl, err := ParseChunker(chunker)
+	if err != nil {
+		return "", nil, err
+	}
+	return chunker, &countingSplitter{BlockSplitter: spl}, nil
+}
+
+// countingSplitter counts the chunks another splitter produces
+type countingSplitter struct {
+	chunk.BlockSplitter
+	chunks int
+}
+
+func (cs *countingSplitter) Split(r io.Reader) chan []byte {
+	in := cs.BlockSplitter.Split(r)
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		for b := range in {
+			cs.chunks++
+			out <- b
+		}
+	}()
+	return out
+}
+
+// dagKeys returns the key of every distinct block in a freshly built
+// dag. Nodes that repeat, like the chunks of a run of zeros, are stored
+// as one block and listed once.
+func dagKeys(nd *mdag.Node) ([]u.Key, error) {
+	seen := make(map[u.Key]bool)
+	var keys []u.Key
+	var walk func(nd *mdag.Node) error
+	walk = func(nd *mdag.Node) error {
+		k, err := nd.Key()
+		if err != nil {
+			return err
+		}
+		if seen[k] {
+			return nil
+		}
+		seen[k] = true
+		keys = append(keys, k)
+		for _, l := range nd.Links {
+			if l.Node != nil {
+				if err := walk(l.Node); err != nil {
+					return err
+				}
+			} else if lk := u.Key(l.Hash); !seen[lk] {
+				seen[lk] = true
+				keys = append(keys, lk)
+			}
+		}
+		return nil
+	}
+	return keys, walk(nd)
+}
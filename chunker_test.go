@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	chunk "github.com/jbenet/go-ipfs/importer/chunk"
+	mdag "github.com/jbenet/go-ipfs/merkledag"
+)
+
+func TestParseChunker(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"size-256KB", true},
+		{"size-1", true},
+		{"rabin-8KB", true},
+		{"rabin-8KB-4KB-16KB", true},
+		{"rabin-8KB-8KB-8KB", true},
+
+		{"size", false},
+		{"size-0", false},
+		{"size-big", false},
+		{"size-1KB-2KB", false},
+		{"rabin", false},
+		{"rabin-8KB-4KB", false},
+		{"rabin-8KB-16KB-32KB", false},
+		{"rabin-8KB-1KB-4KB", false},
+		{"fixed-8KB", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		_, err := ParseChunker(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseChunker(%q): error %v", tt.spec, err)
+		}
+	}
+
+	spl, err := ParseChunker("size-4KB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss, ok := spl.(*chunk.SizeSplitter); !ok || ss.Size != 4096 {
+		t.Errorf("size-4KB gave %#v", spl)
+	}
+
+	spl, err = ParseChunker("rabin-8KB-4KB-16KB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mr, ok := spl.(*chunk.MaybeRabin); !ok || mr.MinBlockSize != 4096 || mr.MaxBlockSize != 16384 {
+		t.Errorf("rabin-8KB-4KB-16KB gave %#v", spl)
+	}
+}
+
+func TestDagKeys(t *testing.T) {
+	// two leaves with the same data are one block
+	root := &mdag.Node{}
+	for _, d := range []string{"zeros", "zeros", "other"} {
+		if err := root.AddNodeLink("", &mdag.Node{Data: []byte(d)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a link whose node isnt loaded is still counted
+	root.Links = append(root.Links, &mdag.Link{Hash: []byte("elsewhere")})
+
+	keys, err := dagKeys(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 4 {
+		t.Fatalf("%d keys, want 4", len(keys))
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"code.google.com/p/go.net/context"
@@ -16,76 +18,199 @@ import (
 	"github.com/jbenet/go-ipfs/core"
 	diagnostics "github.com/jbenet/go-ipfs/diagnostics"
 	imp "github.com/jbenet/go-ipfs/importer"
-	chunk "github.com/jbenet/go-ipfs/importer/chunk"
 	"github.com/jbenet/go-ipfs/p2p/peer"
+	notif "github.com/jbenet/go-ipfs/routing/notifications"
 	uio "github.com/jbenet/go-ipfs/unixfs/io"
 	u "github.com/jbenet/go-ipfs/util"
+	ma "github.com/jbenet/go-multiaddr"
 )
 
+var ErrUnknownCommand = errors.New("unrecognized command!")
+
 type NodeController interface {
 	// Run a command on this node
-	RunCommand(cmd []string) (string, error)
+	RunCommand(ctx context.Context, cmd []string) (string, error)
 
 	// Shutdown this node
 	Shutdown()
 
+	// whether this node is still running
+	Alive() bool
+
+	// peers this node is connected to
+	Peers() []peer.ID
+
+	// number of peers this node is connected to
+	NumPeers() int
+
+	// addresses this node is listening on
+	Addrs() []ma.Multiaddr
+
+	// keys of every block this node holds
+	Blocks(ctx context.Context) ([]u.Key, error)
+
 	GetStatistics() nodeBWInfo
 
+	// whether this node has a value stored locally under the given key
+	HasValue(k u.Key) bool
+
+	// ask peer p which provider records it holds for the given key
+	AskProviders(ctx context.Context, p peer.ID, k u.Key) ([]peer.ID, error)
+
 	// return this nodes peer ID
 	PeerID() peer.ID
 }
 
+// localNode runs commands on a node in this process. n is nil once the
+// node is killed, and is guarded by lk since the script and the http
+// handlers both use it.
 type localNode struct {
-	n *core.IpfsNode
+	lk sync.Mutex
+	n  *core.IpfsNode
+	id peer.ID
+}
+
+func newLocalNode(n *core.IpfsNode) *localNode {
+	return &localNode{n: n, id: n.Identity}
+}
+
+// node returns the running node, or nil if it was killed
+func (l *localNode) node() *core.IpfsNode {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	return l.n
 }
 
-func (l *localNode) RunCommand(cmdparts []string) (string, error) {
-	if l.n == nil {
-		return "", errors.New("Attempted to run command on dead node!")
+// stop closes the node with the given func and forgets it, if no one
+// else got to it first
+func (l *localNode) stop(close func(n *core.IpfsNode)) {
+	l.lk.Lock()
+	n := l.n
+	l.n = nil
+	l.lk.Unlock()
+	if n != nil {
+		close(n)
+	}
+}
+
+func (l *localNode) RunCommand(ctx context.Context, cmdparts []string) (string, error) {
+	n := l.node()
+	if n == nil {
+		return "", ErrDeadNode
 	}
 	cmd := strings.ToLower(cmdparts[1])
 	if cmd == "expectget" {
-		success := AssertGet(l.n, cmdparts[2], cmdparts[3])
-		if !success {
-			return "", errors.New("assert get failed")
+		if len(cmdparts) < 4 {
+			return fmt.Sprintln("expect: 'expect # get key val'"), ErrArgCount
+		}
+		if err := AssertGet(ctx, n, cmdparts[2], cmdparts[3]); err != nil {
+			return "", err
 		}
 		return "assert get successful!\n", nil
 	}
 	fnc, ok := commands[cmd]
 	if !ok {
-		return "", fmt.Errorf("unrecognized command!")
-	} else {
-		out, err := fnc(l.n, cmdparts)
-		if cmd == "kill" {
-			l.n = nil
-		}
+		return "", ErrUnknownCommand
+	} else if cmd == "kill" {
+		out, err := "", ErrDeadNode
+		retireNode(l, func() {
+			l.stop(func(n *core.IpfsNode) {
+				out, err = fnc(ctx, n, cmdparts)
+			})
+		})
 		return out, err
+	} else {
+		return fnc(ctx, n, cmdparts)
 	}
 }
 
+// GetStatistics returns the bytes moved by this node since it started.
+// The network doesnt count dht messages, so those are left at zero.
 func (l *localNode) GetStatistics() nodeBWInfo {
 	out := nodeBWInfo{}
-	//bwi, bwo := l.n.Network.BandwidthTotals()
-	//out.BwIn = bwi
-	//out.BwOut = bwo
-	//out.MesRecv, out.MesSend = l.n.Network.GetMessageCounts()
+	n := l.node()
+	if n == nil || n.Reporter == nil {
+		return out
+	}
+	bw := n.Reporter.GetBandwidthTotals()
+	out.BwIn = uint64(bw.TotalIn)
+	out.BwOut = uint64(bw.TotalOut)
 	return out
 }
 
 func (l *localNode) Shutdown() {
-	if l.n != nil {
-		l.n.Close()
-		l.n = nil
+	if l.Alive() {
+		retireNode(l, func() {
+			l.stop(func(n *core.IpfsNode) { n.Close() })
+		})
 	}
 }
 
+func (l *localNode) Alive() bool {
+	return l.node() != nil
+}
+
+func (l *localNode) Peers() []peer.ID {
+	n := l.node()
+	if n == nil {
+		return nil
+	}
+	return n.PeerHost.Network().Peers()
+}
+
+func (l *localNode) NumPeers() int {
+	return len(l.Peers())
+}
+
+func (l *localNode) Addrs() []ma.Multiaddr {
+	n := l.node()
+	if n == nil {
+		return nil
+	}
+	return n.PeerHost.Addrs()
+}
+
+func (l *localNode) Blocks(ctx context.Context) ([]u.Key, error) {
+	n := l.node()
+	if n == nil {
+		return nil, ErrDeadNode
+	}
+	keys, err := n.Blockstore.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []u.Key
+	for k := range keys {
+		out = append(out, k)
+	}
+	return out, nil
+}
+
+func (l *localNode) HasValue(k u.Key) bool {
+	n := l.node()
+	if n == nil {
+		return false
+	}
+	has, err := n.Datastore.Has(k.DsKey())
+	return err == nil && has
+}
+
+func (l *localNode) AskProviders(ctx context.Context, p peer.ID, k u.Key) ([]peer.ID, error) {
+	n := l.node()
+	if n == nil {
+		return nil, ErrDeadNode
+	}
+	return askProviders(ctx, n.PeerHost, p, k)
+}
+
+// PeerID is kept after the node is killed, its identity doesnt change
 func (l *localNode) PeerID() peer.ID {
-	return l.n.Identity
+	return l.id
 }
 
 // A command func takes a node and a command to run on it
 // and returns the output and any error encountered
-type CmdFunc func(*core.IpfsNode, []string) (string, error)
+type CmdFunc func(context.Context, *core.IpfsNode, []string) (string, error)
 
 var commands map[string]CmdFunc
 
@@ -101,11 +226,26 @@ func init() {
 	commands["bandwidth"] = GetBandwidth
 	commands["add"] = AddFile
 	commands["readfile"] = ReadFile
+	commands["addtree"] = AddTree
+	commands["readtree"] = ReadTree
+	commands["pin"] = PinRef
+	commands["unpin"] = UnpinRef
+	commands["pins"] = ListPins
+	commands["gc"] = GarbageCollect
+	commands["has"] = HasBlock
+	commands["lacks"] = LacksBlock
 	commands["kill"] = KillNode
 }
 
+// RunCommand runs a single line of a script, printing its output to
+// stdout. It returns false when the run should stop.
 func RunCommand(cmdstr string) bool {
-	var async bool
+	return RunCommandTo(os.Stdout, cmdstr)
+}
+
+// RunCommandTo runs a single line of a script, writing its output to w
+func RunCommandTo(w io.Writer, cmdstr string) bool {
+	var async, trace bool
 	if cmdstr == "quit" {
 		return false
 	}
@@ -116,11 +256,30 @@ func RunCommand(cmdstr string) bool {
 		cmdparts = cmdparts[1:]
 	}
 
+	if isProfileCommand(cmdparts) {
+		if err := ProfileCommand(cmdparts); err != nil {
+			fmt.Fprintf(w, "Error: %s\n", err)
+		}
+		return true
+	}
+
+	if cmdparts[0] == "trace" {
+		if len(cmdparts) < 3 || !traceable[strings.ToLower(cmdparts[2])] {
+			fmt.Fprintln(w, "trace: '[go] trace # get|findpeer|findprov args'")
+			return true
+		}
+		trace = true
+		cmdparts = cmdparts[1:]
+	}
+
 	if cmdparts[0] == "expect" {
-		if !Expect(cmdparts[1:]) {
-			// maybe clean up a bit?
-			fmt.Println("Expect failed! Halting!")
-			os.Exit(-1)
+		start := time.Now()
+		err := Expect(w, cmdparts[1:])
+		RecordAssertion(cmdstr, curPos, time.Since(start), err)
+		if err != nil {
+			fmt.Fprintf(w, "Expect failed at %s: %s\nHalting!\n", curPos, err)
+			expectFailed = true
+			return false
 		}
 		return true
 	}
@@ -128,111 +287,310 @@ func RunCommand(cmdstr string) bool {
 	if cmdparts[0][0] == '@' {
 		// create file
 		fname := cmdparts[0][1:]
+		if len(cmdparts) < 2 {
+			fmt.Fprintln(w, "Unrecognized file operation")
+			return false
+		}
 		switch cmdparts[1] {
 		case "make":
-			size, err := strconv.Atoi(cmdparts[2])
+			if len(cmdparts) < 3 {
+				fmt.Fprintln(w, "make: '@name make size [generator opt=val...]'")
+				return false
+			}
+			if cmdparts[2] == "dag" || strings.Contains(cmdparts[2], "=") {
+				ti, err := MakeTree(fname, cmdparts[2:])
+				if err != nil {
+					fmt.Fprintln(w, err)
+					return false
+				}
+				putTree(ti)
+				Emit(&Event{Type: EvFileCreate, Node: -1, File: fname, Cmd: cmdstr})
+				fmt.Fprintf(w, "Created tree '%s' (%s): %d nodes, %d bytes\n", fname, ti.Spec, ti.Nodes, ti.Size)
+				return true
+			}
+			fi, err := MakeFile(fname, cmdparts[2:])
 			if err != nil {
-				fmt.Println(err)
+				fmt.Fprintln(w, err)
 				return false
 			}
-			fi := NewFile(fname, int64(size))
-			files[fname] = fi
-			fmt.Printf("Created '%s' = '%s'\n", fi.Name, fi.RootKey)
+			putFile(fi)
+			Emit(&Event{Type: EvFileCreate, Node: -1, File: fname, Cmd: fi.MakeCmd()})
+			fmt.Fprintf(w, "Created '%s' (%d bytes, %s, seed %d, sha256 %x)\n", fi.Name, fi.Size(), fi.Gen, fi.Seed, fi.Digest)
+		case "load":
+			if len(cmdparts) < 3 {
+				fmt.Fprintln(w, "load: '@name load path [stream]'")
+				return false
+			}
+			stream := len(cmdparts) > 3 && cmdparts[3] == "stream"
+			msg, err := LoadPath(fname, cmdparts[2], stream)
+			if err != nil {
+				fmt.Fprintln(w, err)
+				return false
+			}
+			Emit(&Event{Type: EvFileCreate, Node: -1, File: fname, Cmd: cmdstr})
+			fmt.Fprintln(w, msg)
 		default:
-			fmt.Println("Unrecognized file operation")
+			fmt.Fprintln(w, "Unrecognized file operation")
 			return false
 		}
 		return true
 	}
 
+	if cmdparts[0] == "stats" {
+		PrintStats(w, cmdparts[1:])
+		return true
+	}
+
+	if cmdparts[0] == "keyspace" {
+		if err := KeyspaceCommand(w, cmdparts); err != nil {
+			fmt.Fprintln(w, err)
+		}
+		return true
+	}
+
 	if cmdparts[0] == "sleep" {
 		dur, err := strconv.Atoi(cmdparts[1])
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(w, err)
 			return false
 		}
-		fmt.Printf("Sleeping for %d seconds.\n", dur)
+		fmt.Fprintf(w, "Sleeping for %d seconds.\n", dur)
 		time.Sleep(time.Second * time.Duration(dur))
 		return true
 	}
 
 	idexlist, err := ParseRange(cmdparts[0])
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(w, err)
 		return true
 	}
 
 	if len(cmdparts) < 2 {
-		fmt.Println("must specify command!")
+		fmt.Fprintln(w, "must specify command!")
 		return true
 	}
 
 	if cmdparts[1] == "start" {
-		StartNodes(idexlist)
+		StartNodes(w, idexlist)
 		return true
 	}
 
 	if async {
-		runCommandsAsync(idexlist, cmdparts, false)
+		runCommandsAsync(w, idexlist, cmdparts, trace, false)
 	} else {
-		runCommandsSync(idexlist, cmdparts)
+		runCommandsSync(w, idexlist, cmdparts, trace)
 	}
 
 	return true
 }
 
-func StartNodes(idexlist []int) {
+// held while starting nodes, so the script and the api cant both start
+// the same one
+var startLk sync.Mutex
+
+func StartNodes(w io.Writer, idexlist []int) {
+	startLk.Lock()
+	defer startLk.Unlock()
 	for _, i := range idexlist {
-		if controllers[i] != nil {
-			fmt.Printf("ERROR: node %d already started.\n", i)
+		if i >= numNodes() || i < 0 {
+			fmt.Fprintf(w, "Index %d out of range!\n", i)
+			continue
+		}
+		if c := controller(i); c != nil && c.Alive() {
+			fmt.Fprintf(w, "ERROR: node %d already started.\n", i)
 			continue
 		}
-		controllers[i] = &localNode{nodeFromConfig(masterCtx, configs[i])}
+		if err := startNode(i); err != nil {
+			fmt.Fprintf(w, "ERROR: failed to start node %d: %s\n", i, err)
+		}
 	}
 }
 
-func runCommandsSync(idexlist []int, cmdparts []string) {
+// startNode builds the node with the given index from its config, a
+// node that was killed earlier is brought back with the same identity
+func startNode(i int) error {
+	nd, err := nodeFromConfig(masterCtx, configs[i])
+	if err != nil {
+		return err
+	}
+
+	evtype := EvNodeStart
+	if controller(i) != nil {
+		evtype = EvNodeRestart
+	}
+	nd.PeerHost.Network().Notify(&connNotifiee{node: i})
+	controllersLk.Lock()
+	controllers[i] = newLocalNode(nd)
+	controllersLk.Unlock()
+	Emit(&Event{Type: evtype, Node: i})
+	return nil
+}
+
+// runOnNode runs the given command on a single node and records its
+// result, along with a lookup trace of it if requested
+func runOnNode(idex int, cmdparts []string, trace bool) (string, error) {
+	atomic.AddInt64(&inflight, 1)
+	defer atomic.AddInt64(&inflight, -1)
+
+	cmdline := fmt.Sprintf("%d %s", idex, strings.Join(cmdparts[1:], " "))
+	Emit(&Event{Type: EvCmdIssued, Node: idex, Cmd: cmdline})
+
+	start := time.Now()
+	c := controller(idex)
+	if c == nil {
+		finishCommand(NewResult(idex, cmdparts, start, "", ErrDeadNode), cmdline)
+		return "", ErrDeadNode
+	}
+
+	// lookups are always traced while someone is watching events, so
+	// the visualization can animate them
+	var tr *LookupTrace
+	if trace || (traceable[strings.ToLower(cmdparts[1])] && eventsEnabled()) {
+		tr = NewTrace(idex, cmdparts)
+	}
+	ctx := masterCtx
+	stop := func() {}
+	if tr != nil || eventsEnabled() {
+		ctx, stop = WatchQueries(masterCtx, func(ev *notif.QueryEvent) {
+			if tr != nil {
+				tr.HandleEvent(ev)
+			}
+			emitQueryEvent(idex, ev)
+		})
+	}
+
+	before := c.GetStatistics()
+	out, err := c.RunCommand(ctx, cmdparts)
+	stop()
+
+	r := NewResult(idex, cmdparts, start, out, err)
+	if c.Alive() {
+		after := c.GetStatistics()
+		if after.BwIn >= before.BwIn && after.BwOut >= before.BwOut {
+			r.BwIn = after.BwIn - before.BwIn
+			r.BwOut = after.BwOut - before.BwOut
+		}
+	}
+	if err == nil {
+		r.Bytes = commandBytes(cmdparts)
+	}
+	finishCommand(r, cmdline)
+
+	if tr != nil {
+		tr.Finish(err)
+		rememberLookup(tr)
+	}
+	if trace {
+		out += tr.String()
+		if err := tr.Save(tracedir); err != nil {
+			fmt.Printf("Failed to save trace: %s\n", err)
+		}
+	}
+	return out, err
+}
+
+// finishCommand records a commands result and logs its completion,
+// along with any lifecycle change it caused
+func finishCommand(r *Result, cmdline string) {
+	RecordResult(r)
+	Emit(&Event{
+		Type:     EvCmdDone,
+		Node:     r.Node,
+		Cmd:      cmdline,
+		Duration: r.Duration,
+		Success:  r.Success,
+		Error:    r.Error,
+		Output:   r.Output,
+	})
+	if !r.Success {
+		return
+	}
+
+	switch r.Command {
+	case "kill":
+		Emit(&Event{Type: EvNodeKill, Node: r.Node})
+	case "add":
+		if f, ok := getFile(r.Args[0]); ok {
+			Emit(&Event{Type: EvFileAdd, Node: r.Node, File: f.Name, Key: f.root().Pretty()})
+		}
+	case "addtree":
+		if t, ok := getTree(r.Args[0]); ok {
+			Emit(&Event{Type: EvFileAdd, Node: r.Node, File: t.Name, Key: t.root().Pretty()})
+		}
+	}
+}
+
+// commandBytes returns the amount of file data moved by a command
+func commandBytes(cmdparts []string) int64 {
+	switch strings.ToLower(cmdparts[1]) {
+	case "add", "readfile":
+		if len(cmdparts) < 3 {
+			return 0
+		}
+		f, ok := getFile(cmdparts[2])
+		if !ok {
+			return 0
+		}
+		if strings.ToLower(cmdparts[1]) == "readfile" {
+			if _, length, _, err := readRange(f, cmdparts[3:]); err == nil {
+				return length
+			}
+		}
+		return f.Size()
+	case "addtree", "readtree":
+		if len(cmdparts) < 3 {
+			return 0
+		}
+		if t, ok := getTree(cmdparts[2]); ok {
+			return t.Size
+		}
+	}
+	return 0
+}
+
+func runCommandsSync(w io.Writer, idexlist []int, cmdparts []string, trace bool) {
 	for _, idex := range idexlist {
-		if idex >= len(controllers) || idex < 0 {
-			fmt.Printf("Index %d out of range!\n", idex)
+		if idex >= numNodes() || idex < 0 {
+			fmt.Fprintf(w, "Index %d out of range!\n", idex)
 			return
 		}
-		if controllers[idex] == nil {
-			fmt.Printf("Node %d has already been killed.\n", idex)
+		if controller(idex) == nil {
+			fmt.Fprintf(w, "Node %d has already been killed.\n", idex)
 		}
-		out, err := controllers[idex].RunCommand(cmdparts)
+		out, err := runOnNode(idex, cmdparts, trace)
 		if !logquiet {
-			fmt.Print(out)
+			fmt.Fprint(w, out)
 		}
 		if err != nil {
-			fmt.Printf("Error: %s\n", err)
+			fmt.Fprintf(w, "Error: %s\n", err)
 		}
 	}
 }
 
-func runCommandsAsync(idexlist []int, cmdparts []string, wait bool) {
+func runCommandsAsync(w io.Writer, idexlist []int, cmdparts []string, trace, wait bool) {
 	done := make(chan struct{})
 	for _, i := range idexlist {
-		if i >= len(controllers) || i < 0 {
-			fmt.Printf("Index %d out of range!\n", i)
+		if i >= numNodes() || i < 0 {
+			fmt.Fprintf(w, "Index %d out of range!\n", i)
 			return
 		}
-		if controllers[i] == nil {
-			fmt.Printf("Node %d has already been killed.\n", i)
+		if controller(i) == nil {
+			fmt.Fprintf(w, "Node %d has already been killed.\n", i)
 		}
 	}
 	for _, idex := range idexlist {
-		if controllers[idex] == nil {
-			fmt.Println("Attempted to run command on dead node!")
+		if controller(idex) == nil {
+			fmt.Fprintln(w, "Attempted to run command on dead node!")
 			continue
 		}
 		go func(i int) {
-			out, err := controllers[idex].RunCommand(cmdparts)
+			defer RecoverPanic()
+			out, err := runOnNode(i, cmdparts, trace)
 			if !logquiet {
-				fmt.Print(out)
+				fmt.Fprint(w, out)
 			}
 			if err != nil {
-				fmt.Printf("Error: %s\n", err)
+				fmt.Fprintf(w, "Error: %s\n", err)
 			}
 			if wait {
 				done <- struct{}{}
@@ -246,72 +604,67 @@ func runCommandsAsync(idexlist []int, cmdparts []string, wait bool) {
 	}
 }
 
-func AssertGet(n *core.IpfsNode, key, exp string) bool {
-	ctx, _ := context.WithDeadline(context.TODO(), time.Now().Add(time.Second*5))
+func AssertGet(ctx context.Context, n *core.IpfsNode, key, exp string) error {
+	ctx, _ = context.WithDeadline(ctx, time.Now().Add(time.Second*5))
 	val, err := n.Routing.GetValue(ctx, u.Key(key))
 	if err != nil {
-		fmt.Printf("Get error: %s\n", err)
-		return false
+		return fmt.Errorf("get error: %s", err)
 	}
 
 	if string(val) != exp {
-		fmt.Printf("expected '%s' but got '%s' instead.\n", exp, string(val))
-		return false
+		return fmt.Errorf("expected '%s' but got '%s' instead", exp, string(val))
 	}
 
 	if !logquiet {
 		fmt.Println("Expectation Successful!")
 	}
-	return true
+	return nil
 }
 
-func Expect(cmdparts []string) bool {
+// Expect runs the given command on every node in the range, failing if
+// any of them fails
+func Expect(w io.Writer, cmdparts []string) error {
+	if len(cmdparts) < 2 {
+		return errors.New("must specify command!")
+	}
 	idexlist, err := ParseRange(cmdparts[0])
 	if err != nil {
-		fmt.Println(err)
-		return false
+		return err
 	}
 
 	for _, idex := range idexlist {
-		if idex >= len(controllers) || idex < 0 {
-			fmt.Printf("Index %d out of range!\n", idex)
-			return false
-		}
-		if len(cmdparts) < 2 {
-			fmt.Println("must specify command!")
-			return false
+		if idex >= numNodes() || idex < 0 {
+			return fmt.Errorf("Index %d out of range!", idex)
 		}
 		cmd := strings.ToLower(cmdparts[1])
 		if cmd == "get" {
 			cmdparts[1] = "expectget"
 		}
-		out, err := controllers[idex].RunCommand(cmdparts)
+		out, err := runOnNode(idex, cmdparts, false)
 		if !logquiet {
-			fmt.Print(out)
+			fmt.Fprint(w, out)
 		}
 		if err != nil {
-			fmt.Printf("Error: %s\n", err)
-			return false
+			return fmt.Errorf("node %d: %s", idex, err)
 		}
-
 	}
-	return true
+	return nil
 }
 
-func Put(n *core.IpfsNode, cmdparts []string) (string, error) {
+func Put(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
 	if len(cmdparts) < 4 {
 		return fmt.Sprintln("put: '# put key val'"), ErrArgCount
 	}
 	msg := fmt.Sprintf("putting value: '%s' for key '%s'\n", cmdparts[3], cmdparts[2])
-	ctx, _ := context.WithDeadline(context.TODO(), time.Now().Add(time.Second*5))
+	ctx, _ = context.WithDeadline(ctx, time.Now().Add(time.Second*5))
 	return msg, n.Routing.PutValue(ctx, u.Key(cmdparts[2]), []byte(cmdparts[3]))
 }
 
-func Get(n *core.IpfsNode, cmdparts []string) (string, error) {
+func Get(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
 	if len(cmdparts) < 3 {
 		return fmt.Sprintln("get: '# get key'"), ErrArgCount
 	}
-	ctx, _ := context.WithDeadline(context.TODO(), time.Now().Add(time.Second*5))
+	ctx, _ = context.WithDeadline(ctx, time.Now().Add(time.Second*5))
 	val, err := n.Routing.GetValue(ctx, u.Key(cmdparts[2]))
 	if err != nil {
 		return "", err
@@ -319,7 +672,7 @@ func Get(n *core.IpfsNode, cmdparts []string) (string, error) {
 	return fmt.Sprintf("Got value: '%s'\n", string(val)), nil
 }
 
-func Diag(n *core.IpfsNode, cmdparts []string) (string, error) {
+func Diag(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
 	diag, err := n.Diagnostics.GetDiagnostic(time.Second * 5)
 	if err != nil {
 		return "", err
@@ -348,7 +701,7 @@ func Diag(n *core.IpfsNode, cmdparts []string) (string, error) {
 	return out.String(), nil
 }
 
-func Store(n *core.IpfsNode, cmdparts []string) (string, error) {
+func Store(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
 	if len(cmdparts) < 4 {
 		return fmt.Sprintln("store: '# store key val'"), ErrArgCount
 	}
@@ -360,11 +713,11 @@ func Store(n *core.IpfsNode, cmdparts []string) (string, error) {
 	return "", nil
 }
 
-func Provide(n *core.IpfsNode, cmdparts []string) (string, error) {
+func Provide(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
 	if len(cmdparts) < 3 {
 		return fmt.Sprintln("provide: '# provide key'"), ErrArgCount
 	}
-	ctx, _ := context.WithDeadline(context.TODO(), time.Now().Add(time.Second*5))
+	ctx, _ = context.WithDeadline(ctx, time.Now().Add(time.Second*5))
 	err := n.Routing.Provide(ctx, u.Key(cmdparts[2]))
 	if err != nil {
 		return "", err
@@ -372,7 +725,7 @@ func Provide(n *core.IpfsNode, cmdparts []string) (string, error) {
 	return "", nil
 }
 
-func FindProv(n *core.IpfsNode, cmdparts []string) (string, error) {
+func FindProv(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
 	if len(cmdparts) < 3 {
 		return fmt.Sprintln("findprov: '# findprov key [count]'"), ErrArgCount
 	}
@@ -384,7 +737,7 @@ func FindProv(n *core.IpfsNode, cmdparts []string) (string, error) {
 			return "", err
 		}
 	}
-	ctx, _ := context.WithDeadline(context.TODO(), time.Now().Add(time.Second*5))
+	ctx, _ = context.WithDeadline(ctx, time.Now().Add(time.Second*5))
 	pchan := n.Routing.FindProvidersAsync(ctx, u.Key(cmdparts[2]), count)
 
 	out := new(bytes.Buffer)
@@ -395,84 +748,213 @@ func FindProv(n *core.IpfsNode, cmdparts []string) (string, error) {
 	return out.String(), nil
 }
 
-func ReadFile(n *core.IpfsNode, cmdparts []string) (string, error) {
+func ReadFile(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
 	if len(cmdparts) < 3 {
-		return fmt.Sprintln("readfile: '# add fileref'"), ErrArgCount
+		return fmt.Sprintln("readfile: '# readfile fileref [offset=N] [length=N]'"), ErrArgCount
 	}
 
-	f, ok := files[cmdparts[2]]
+	f, ok := getFile(cmdparts[2])
 	if !ok {
 		return fmt.Sprintf("No such file: %s\n", cmdparts[2]), u.ErrNotFound
 	}
 
-	if f.RootKey == "" {
+	root := f.root()
+	if root == "" {
 		return "", errors.New("file hasnt been added by anyone else")
 	}
 
-	start := time.Now()
-	nd, err := n.DAG.Get(f.RootKey)
+	offset, length, ranged, err := readRange(f, cmdparts[3:])
 	if err != nil {
 		return "", err
 	}
 
-	read, err := uio.NewDagReader(nd, n.DAG)
-	if err != nil {
-		return "", err
+	// the content is checked on the side, so neither hashing nor
+	// regenerating the original is counted in the read times. Whole
+	// reads of generated files are checked against their digest,
+	// anything else against the original from offset on.
+	var check func(got io.Reader) (int64, error)
+	if f.Digest != nil && offset == 0 && !ranged {
+		check = f.checkDigest
+	} else {
+		orig, err := f.OpenAt(offset)
+		if err != nil {
+			return "", err
+		}
+		defer orig.Close()
+		check = func(got io.Reader) (int64, error) {
+			return compareContent(got, io.LimitReader(orig, length))
+		}
 	}
-	b, err := ioutil.ReadAll(read)
+	chunks := make(chan []byte, 64)
+	checked := make(chan error, 1)
+	go func() {
+		_, err := check(&chunkReader{ch: chunks})
+		// keep taking chunks after a mismatch, so the read can finish
+		for range chunks {
+		}
+		checked <- err
+	}()
+
+	start := time.Now()
+	size, first, err := readDag(n, root, offset, length, ranged, chunks)
+	end := time.Now()
+	close(chunks)
+	cerr := <-checked
 	if err != nil {
 		return fmt.Sprintln("Failed to read file."), err
 	}
-	end := time.Now()
-	if !bytes.Equal(b, f.Data) {
+	if cerr == ErrContentMismatch {
 		return "", errors.New("File we read doesnt match original bytes")
 	}
+	if cerr != nil {
+		return fmt.Sprintln("Failed to check file."), cerr
+	}
 
 	took := end.Sub(start)
-	bps := float64(len(b)) / took.Seconds()
+	bps := float64(size) / took.Seconds()
 
 	trans := transferInfo{}
 	trans.Time = took.Nanoseconds()
-	trans.Size = len(b)
+	trans.Size = int(size)
 	trans.Speed = bps
 	gslock.Lock()
 	globalStats.Transfers = append(globalStats.Transfers, trans)
 	gslock.Unlock()
 
-	return fmt.Sprintf("Read File Succeeded: %f bytes per second\n", bps), nil
+	ttfb := "none"
+	if !first.IsZero() {
+		ttfb = first.Sub(start).String()
+	}
+	return fmt.Sprintf("Read File Succeeded: %d bytes from offset %d, first byte after %s, total %s, %f bytes per second\n",
+		size, offset, ttfb, took, bps), nil
+}
+
+// readDag reads the dag under root from offset to its end, or for
+// length bytes if ranged, passing what it reads on to chunks. It
+// returns the bytes read and when the first of them arrived.
+func readDag(n *core.IpfsNode, root u.Key, offset, length int64, ranged bool, chunks chan<- []byte) (int64, time.Time, error) {
+	var first time.Time
+	nd, err := n.DAG.Get(root)
+	if err != nil {
+		return 0, first, err
+	}
+	dr, err := uio.NewDagReader(nd, n.DAG)
+	if err != nil {
+		return 0, first, err
+	}
+	if _, err := dr.Seek(offset, 0); err != nil {
+		return 0, first, err
+	}
+	var r io.Reader = dr
+	if ranged {
+		r = io.LimitReader(dr, length)
+	}
+
+	var size int64
+	for {
+		buf := make([]byte, 64*1024)
+		n, err := r.Read(buf)
+		if n > 0 {
+			if first.IsZero() {
+				first = time.Now()
+			}
+			size += int64(n)
+			chunks <- buf[:n]
+		}
+		if err == io.EOF {
+			return size, first, nil
+		}
+		if err != nil {
+			return size, first, err
+		}
+	}
+}
+
+// readRange parses the offset= and length= options of readfile, the
+// default being the whole file. ranged is whether length was given.
+func readRange(f *FileInfo, opts []string) (offset, length int64, ranged bool, err error) {
+	length = -1
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || (kv[0] != "offset" && kv[0] != "length") {
+			return 0, 0, false, fmt.Errorf("unknown readfile option '%s'", opt)
+		}
+		v, err := ParseSize(kv[1])
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if kv[0] == "offset" {
+			offset = v
+		} else {
+			length = v
+			ranged = true
+		}
+	}
+	if offset > f.Size() {
+		return 0, 0, false, fmt.Errorf("offset %d is past the end of the file (%d bytes)", offset, f.Size())
+	}
+	if length < 0 || offset+length > f.Size() {
+		length = f.Size() - offset
+	}
+	return offset, length, ranged, nil
 }
 
-func AddFile(n *core.IpfsNode, cmdparts []string) (string, error) {
+func AddFile(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
 	if len(cmdparts) < 3 {
-		return fmt.Sprintln("addfile: '# add fileref'"), ErrArgCount
+		return fmt.Sprintln("addfile: '# add fileref [chunker=size-N|rabin-AVG[-MIN-MAX]]'"), ErrArgCount
 	}
 
-	f, ok := files[cmdparts[2]]
+	f, ok := getFile(cmdparts[2])
 	if !ok {
 		return fmt.Sprintf("No such file: %s\n", cmdparts[2]), u.ErrNotFound
 	}
 
-	nd, err := imp.BuildDagFromReader(f.GetReader(), n.DAG, n.Pinning.GetManual(), chunk.DefaultSplitter)
+	chunker, cs, err := parseAddOpts(cmdparts[3:])
 	if err != nil {
 		return "", err
 	}
 
-	if f.RootKey == "" {
-		k, err := nd.Key()
-		if err != nil {
-			return "", err
-		}
+	r, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	nd, err := imp.BuildDagFromReader(r, n.DAG, n.Pinning.GetManual(), cs)
+	if err != nil {
+		return "", err
+	}
+
+	k, err := nd.Key()
+	if err != nil {
+		return "", err
+	}
+	keys, err := dagKeys(nd)
+	if err != nil {
+		return "", err
+	}
+	blocks := len(keys)
+
+	// the file is read back through the dag of its first add, or of
+	// the latest add to chunk it differently
+	filesLk.Lock()
+	if f.RootKey == "" || f.Chunker != chunker {
 		f.RootKey = k
+		f.Chunker = chunker
+		f.Chunks = cs.chunks
+		f.Blocks = blocks
+		f.keys = keys
 	}
+	filesLk.Unlock()
 
 	err = n.DAG.AddRecursive(nd)
 	if err != nil {
 		return "", err
 	}
-	return "File Added\n", nil
+	return fmt.Sprintf("File Added (%s): %d chunks, %d blocks\n", chunker, cs.chunks, blocks), nil
 }
 
-func FindPeer(n *core.IpfsNode, cmdparts []string) (string, error) {
+func FindPeer(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
 	out := new(bytes.Buffer)
 	if len(cmdparts) < 3 {
 		return fmt.Sprintln("findpeer: '# findpeer peerid'"), ErrArgCount
@@ -484,32 +966,36 @@ func FindPeer(n *core.IpfsNode, cmdparts []string) (string, error) {
 		if err != nil {
 			return "", err
 		}
-		if n >= len(controllers) {
+		c := controller(n)
+		if c == nil {
 			return "", errors.New("specified peernum out of range")
 		}
-		search = controllers[n].PeerID()
+		search = c.PeerID()
 	} else {
 		search = peer.ID(b58.Decode(cmdparts[2]))
 	}
 	fmt.Fprintf(out, "Searching for peer: %s\n", search)
 
-	ctx, _ := context.WithDeadline(context.TODO(), time.Now().Add(time.Second*5))
+	ctx, _ = context.WithDeadline(ctx, time.Now().Add(time.Second*5))
 	p, err := n.Routing.FindPeer(ctx, search)
 	if err != nil {
 		return "", err
 	}
 
-	fmt.Fprintf(out, "%Got peer: %s\n", p)
+	fmt.Fprintf(out, "Got peer: %s\n", p)
 	return out.String(), nil
 }
 
-func KillNode(n *core.IpfsNode, cmdparts []string) (string, error) {
+func KillNode(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
 	n.Close()
 	return "Node Killed", nil
 }
 
-func GetBandwidth(n *core.IpfsNode, cmdparts []string) (string, error) {
-	//in, out := n.Network.BandwidthTotals()
-	in, out := -1, -1
+func GetBandwidth(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
+	if n.Reporter == nil {
+		return "", errors.New("node has no bandwidth reporter")
+	}
+	bw := n.Reporter.GetBandwidthTotals()
+	in, out := bw.TotalIn, bw.TotalOut
 	return fmt.Sprintf("Bandwidth totals\n\tIn:  %d\n\tOut: %d\n", in, out), nil
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jbenet/go-ipfs/core"
+)
+
+func TestLocalNodeStopsOnce(t *testing.T) {
+	l := &localNode{n: new(core.IpfsNode), id: "a"}
+
+	var closed int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			l.stop(func(n *core.IpfsNode) { atomic.AddInt64(&closed, 1) })
+		}()
+		go func() {
+			defer wg.Done()
+			l.Alive()
+			l.GetStatistics()
+		}()
+	}
+	wg.Wait()
+
+	if closed != 1 {
+		t.Fatalf("node closed %d times", closed)
+	}
+	if l.Alive() || l.PeerID() != "a" {
+		t.Fatalf("alive %v, peer %q after stop", l.Alive(), l.PeerID())
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// Thresholds past which a change between two runs counts as a regression
+type Thresholds struct {
+	// fractional increase allowed in p50, p90 and p99 latency
+	Latency float64
+
+	// latency changes smaller than this are always ignored as noise
+	MinLatency time.Duration
+
+	// absolute drop allowed in success rate
+	Success float64
+
+	// fractional increase allowed in bandwidth used per operation
+	Bandwidth float64
+
+	// fractional drop allowed in median transfer speed
+	Speed float64
+}
+
+// CommandSummary is what we compare between runs for one command type
+type CommandSummary struct {
+	Latency *LatencySummary
+
+	// mean bytes sent and received by the node per operation
+	Bandwidth float64
+
+	// median bytes per second of successful operations that moved
+	// file data, zero if there were none
+	Speed float64
+}
+
+// SummarizeCommand builds the comparison summary of a set of results
+func SummarizeCommand(rs []*Result) *CommandSummary {
+	cs := &CommandSummary{Latency: Summarize(rs)}
+
+	var bw uint64
+	var speeds []float64
+	for _, r := range rs {
+		bw += r.BwIn + r.BwOut
+		if r.Success && r.Bytes > 0 && r.Duration > 0 {
+			speeds = append(speeds, float64(r.Bytes)/r.Duration.Seconds())
+		}
+	}
+	if len(rs) > 0 {
+		cs.Bandwidth = float64(bw) / float64(len(rs))
+	}
+	if len(speeds) > 0 {
+		sort.Float64s(speeds)
+		cs.Speed = speeds[len(speeds)/2]
+	}
+	return cs
+}
+
+// RunCompare implements 'dhtHell compare baseline candidate', it returns
+// the exit status: 0 if there were no regressions, 1 if there were, and
+// 2 if the results could not be compared
+func RunCompare(args []string) int {
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	th := Thresholds{}
+	fs.Float64Var(&th.Latency, "latency", 0.2, "allowed fractional increase in latency percentiles")
+	fs.DurationVar(&th.MinLatency, "minlatency", time.Millisecond*5, "latency changes smaller than this are ignored")
+	fs.Float64Var(&th.Success, "success", 0.05, "allowed absolute drop in success rate")
+	fs.Float64Var(&th.Bandwidth, "bandwidth", 0.2, "allowed fractional increase in bandwidth per operation")
+	fs.Float64Var(&th.Speed, "speed", 0.2, "allowed fractional drop in transfer speed")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fmt.Println("usage: dhtHell compare [flags] baseline.json candidate.json")
+		return 2
+	}
+
+	base, err := LoadResults(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Error loading baseline: %s\n", err)
+		return 2
+	}
+	cand, err := LoadResults(fs.Arg(1))
+	if err != nil {
+		fmt.Printf("Error loading candidate: %s\n", err)
+		return 2
+	}
+
+	if CompareResults(os.Stdout, base, cand, th) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// CompareResults writes a per command comparison of the two runs and
+// returns the number of regressions found
+func CompareResults(w io.Writer, base, cand []*Result, th Thresholds) int {
+	bcmds := ResultsByCommand(base)
+	ccmds := ResultsByCommand(cand)
+
+	var cmds []string
+	for c := range bcmds {
+		cmds = append(cmds, c)
+	}
+	for c := range ccmds {
+		if _, ok := bcmds[c]; !ok {
+			cmds = append(cmds, c)
+		}
+	}
+	sort.Strings(cmds)
+
+	regressions := 0
+	for _, c := range cmds {
+		if len(bcmds[c]) == 0 {
+			fmt.Fprintf(w, "%s: only in candidate, not compared\n", c)
+			continue
+		}
+		if len(ccmds[c]) == 0 {
+			fmt.Fprintf(w, "%s: missing from candidate\n", c)
+			regressions++
+			continue
+		}
+
+		b := SummarizeCommand(bcmds[c])
+		n := SummarizeCommand(ccmds[c])
+		fmt.Fprintf(w, "%s: (%d ops -> %d ops)\n", c, b.Latency.Count, n.Latency.Count)
+
+		regressions += compareLatency(w, "p50", b.Latency.P50, n.Latency.P50, th)
+		regressions += compareLatency(w, "p90", b.Latency.P90, n.Latency.P90, th)
+		regressions += compareLatency(w, "p99", b.Latency.P99, n.Latency.P99, th)
+
+		bs, ns := b.Latency.SuccessRate(), n.Latency.SuccessRate()
+		regressions += compareLine(w, "success", fmt.Sprintf("%.1f%%", bs*100),
+			fmt.Sprintf("%.1f%%", ns*100), ns < bs-th.Success)
+
+		// a baseline without bandwidth was recorded before nodes reported
+		// it, so there is nothing to regress from
+		regressions += compareLine(w, "bandwidth", fmt.Sprintf("%.0f B/op", b.Bandwidth),
+			fmt.Sprintf("%.0f B/op", n.Bandwidth), b.Bandwidth > 0 && n.Bandwidth > b.Bandwidth*(1+th.Bandwidth))
+
+		if b.Speed > 0 || n.Speed > 0 {
+			regressions += compareLine(w, "speed", fmt.Sprintf("%.0f B/s", b.Speed),
+				fmt.Sprintf("%.0f B/s", n.Speed), n.Speed < b.Speed*(1-th.Speed))
+		}
+	}
+
+	if regressions > 0 {
+		fmt.Fprintf(w, "%d regressions found.\n", regressions)
+	} else {
+		fmt.Fprintln(w, "No regressions found.")
+	}
+	return regressions
+}
+
+func compareLatency(w io.Writer, name string, base, cand time.Duration, th Thresholds) int {
+	worse := cand-base > th.MinLatency && float64(cand) > float64(base)*(1+th.Latency)
+	return compareLine(w, name, base.String(), cand.String(), worse)
+}
+
+func compareLine(w io.Writer, name, base, cand string, regressed bool) int {
+	mark := ""
+	if regressed {
+		mark = "  REGRESSION"
+	}
+	fmt.Fprintf(w, "\t%-10s %-14s -> %-14s%s\n", name, base, cand, mark)
+	if regressed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+var testThresholds = Thresholds{
+	Latency:    0.2,
+	MinLatency: time.Millisecond * 5,
+	Success:    0.05,
+	Bandwidth:  0.2,
+	Speed:      0.2,
+}
+
+// run builds n results of a command taking d each, the first failed of
+// which are failures. Each moves bytes of file data using bw bytes of
+// bandwidth.
+func run(cmd string, n, failed int, d time.Duration, bytes int64, bw uint64) []*Result {
+	var rs []*Result
+	for i := 0; i < n; i++ {
+		rs = append(rs, &Result{
+			Command:  cmd,
+			Duration: d,
+			Success:  i >= failed,
+			Bytes:    bytes,
+			BwIn:     bw,
+		})
+	}
+	return rs
+}
+
+func TestCompareResults(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name        string
+		base, cand  []*Result
+		regressions int
+	}{
+		{"equal",
+			run("get", 10, 0, 100*ms, 0, 1000), run("get", 10, 0, 100*ms, 0, 1000), 0},
+
+		// a single duration per run makes p50, p90 and p99 move together
+		{"latency just under",
+			run("get", 10, 0, 100*ms, 0, 0), run("get", 10, 0, 119*ms, 0, 0), 0},
+		{"latency just over",
+			run("get", 10, 0, 100*ms, 0, 0), run("get", 10, 0, 121*ms, 0, 0), 3},
+		{"latency faster",
+			run("get", 10, 0, 100*ms, 0, 0), run("get", 10, 0, 50*ms, 0, 0), 0},
+		{"latency under min",
+			run("get", 10, 0, 1*ms, 0, 0), run("get", 10, 0, 4*ms, 0, 0), 0},
+		{"latency just over min",
+			run("get", 10, 0, 1*ms, 0, 0), run("get", 10, 0, 7*ms, 0, 0), 3},
+
+		{"success just under",
+			run("get", 100, 0, 10*ms, 0, 0), run("get", 100, 4, 10*ms, 0, 0), 0},
+		{"success just over",
+			run("get", 100, 0, 10*ms, 0, 0), run("get", 100, 6, 10*ms, 0, 0), 1},
+
+		{"bandwidth just under",
+			run("get", 10, 0, 10*ms, 0, 1000), run("get", 10, 0, 10*ms, 0, 1190), 0},
+		{"bandwidth just over",
+			run("get", 10, 0, 10*ms, 0, 1000), run("get", 10, 0, 10*ms, 0, 1210), 1},
+
+		{"speed just under",
+			run("readfile", 10, 0, time.Second, 1000, 0), run("readfile", 10, 0, time.Second, 810, 0), 0},
+		{"speed just over",
+			run("readfile", 10, 0, time.Second, 1000, 0), run("readfile", 10, 0, time.Second, 790, 0), 1},
+
+		{"missing baseline",
+			nil, run("get", 10, 0, 10*ms, 0, 1000), 0},
+		{"missing candidate",
+			run("get", 10, 0, 10*ms, 0, 1000), nil, 1},
+		{"new command in candidate",
+			run("get", 10, 0, 10*ms, 0, 0), append(run("get", 10, 0, 10*ms, 0, 0), run("put", 1, 1, time.Second, 0, 0)...), 0},
+
+		{"zero latency baseline",
+			run("get", 10, 0, 0, 0, 0), run("get", 10, 0, 4*ms, 0, 0), 0},
+		{"zero bandwidth baseline",
+			run("get", 10, 0, 10*ms, 0, 0), run("get", 10, 0, 10*ms, 0, 500), 0},
+		{"zero speed baseline",
+			run("readfile", 10, 0, time.Second, 0, 0), run("readfile", 10, 0, time.Second, 1000, 0), 0},
+		{"zero speed candidate",
+			run("readfile", 10, 0, time.Second, 1000, 0), run("readfile", 10, 0, time.Second, 0, 0), 1},
+	}
+
+	for _, tt := range tests {
+		got := CompareResults(ioutil.Discard, tt.base, tt.cand, testThresholds)
+		if got != tt.regressions {
+			t.Errorf("%s: %d regressions, want %d", tt.name, got, tt.regressions)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// streamWriter passes command output on to an http response as it is
+// written. Async commands can outlive the request, so once it is over
+// their output goes to stdout instead.
+type streamWriter struct {
+	lk   sync.Mutex
+	w    http.ResponseWriter
+	fl   http.Flusher
+	done bool
+}
+
+func newStreamWriter(w http.ResponseWriter) *streamWriter {
+	fl, _ := w.(http.Flusher)
+	return &streamWriter{w: w, fl: fl}
+}
+
+func (sw *streamWriter) Write(b []byte) (int, error) {
+	sw.lk.Lock()
+	defer sw.lk.Unlock()
+	if sw.done {
+		return os.Stdout.Write(b)
+	}
+	n, err := sw.w.Write(b)
+	if sw.fl != nil {
+		sw.fl.Flush()
+	}
+	return n, err
+}
+
+func (sw *streamWriter) Close() {
+	sw.lk.Lock()
+	sw.done = true
+	sw.lk.Unlock()
+}
+
+// ServeCommand runs the posted 'cmd' through the same path as commands
+// read from stdin, one line at a time, streaming the output back
+func ServeCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "commands must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	cmds := strings.TrimSpace(r.FormValue("cmd"))
+	if cmds == "" {
+		http.Error(w, "no command given", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	sw := newStreamWriter(w)
+	defer sw.Close()
+
+	for _, line := range strings.Split(cmds, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if !logquiet {
+			fmt.Printf("web> %s\n", line)
+		}
+		if !RunCommandTo(sw, line) {
+			if !endsRun(line) {
+				fmt.Fprintf(sw, "'%s' failed, skipping the rest. The run goes on.\n", line)
+				return
+			}
+			fmt.Fprintln(sw, "Run is ending.")
+			sw.Close()
+			go Shutdown(ExitOK)
+			return
+		}
+	}
+}
+
+// endsRun tells whether a line that RunCommandTo stopped at should end
+// the run. quit and failed expectations do, a line that merely failed to
+// parse, like a typo in the control panel, doesnt.
+func endsRun(line string) bool {
+	return line == "quit" || expectFailed
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	inet "github.com/jbenet/go-ipfs/p2p/net"
+	"github.com/jbenet/go-ipfs/p2p/peer"
+	notif "github.com/jbenet/go-ipfs/routing/notifications"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+// Event types
+const (
+	EvRunStart    = "run_start"
+	EvNodeStart   = "node_start"
+	EvNodeRestart = "node_restart"
+	EvNodeKill    = "node_kill"
+	EvConnOpen    = "conn_open"
+	EvConnClose   = "conn_close"
+	EvCmdIssued   = "cmd_issued"
+	EvCmdDone     = "cmd_done"
+	EvDhtQuery    = "dht_query"
+	EvDhtResponse = "dht_response"
+	EvDhtError    = "dht_error"
+	EvDhtFound    = "dht_found"
+	EvFileCreate  = "file_create"
+	EvFileAdd     = "file_add"
+	EvLookup      = "lookup"
+)
+
+// Event is a single thing that happened during a run, the log of them
+// is written out as one json object per line
+type Event struct {
+	Seq  uint64        `json:"seq"`
+	T    time.Duration `json:"t"` // since the start of the run, monotonic
+	Time time.Time     `json:"time"`
+	Type string        `json:"type"`
+
+	// node the event happened on, -1 if it isnt specific to a node
+	Node int    `json:"node"`
+	Peer string `json:"peer,omitempty"`
+
+	// the other end of a connection or dht rpc
+	Remote     string `json:"remote,omitempty"`
+	RemoteNode *int   `json:"remote_node,omitempty"`
+
+	Cmd      string        `json:"cmd,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Success  bool          `json:"success,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Output   string        `json:"output,omitempty"`
+	File     string        `json:"file,omitempty"`
+	Key      string        `json:"key,omitempty"`
+
+	// id of a finished lookup, see /ops
+	Op int `json:"op,omitempty"`
+
+	Setup *RunSetup `json:"setup,omitempty"`
+}
+
+// RunSetup is everything needed to rebuild the network of a run, it is
+// logged with the run_start event once the initial nodes are up
+type RunSetup struct {
+	Seed      int64            `json:"seed"`
+	Nodes     int              `json:"nodes"`
+	Bootstrap map[int][]int    `json:"bootstrap"`
+	Off       []int            `json:"off,omitempty"`
+	Groups    map[string][]int `json:"groups,omitempty"`
+}
+
+// CurrentSetup describes the network as it was configured
+func CurrentSetup() *RunSetup {
+	rs := &RunSetup{
+		Seed:      identitySeed,
+		Nodes:     len(configs),
+		Bootstrap: make(map[int][]int),
+		Groups:    nodeGroups,
+	}
+	for i, c := range configs {
+		for _, bsp := range c.Bootstrap {
+			if j := nodeIndexByID(bsp.PeerID); j >= 0 {
+				rs.Bootstrap[i] = append(rs.Bootstrap[i], j)
+			}
+		}
+		if disabledAtStart[i] {
+			rs.Off = append(rs.Off, i)
+		}
+	}
+	return rs
+}
+
+var runStart = time.Now()
+
+var evlock sync.Mutex
+var evseq uint64
+var evlog io.WriteCloser
+var evenc *json.Encoder
+
+// live subscribers to the event stream, like the viz server
+var evsubs = make(map[chan *Event]struct{})
+
+// OpenEventLog starts appending every event to the given file
+func OpenEventLog(path string) error {
+	fi, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	evlock.Lock()
+	evlog = fi
+	evenc = json.NewEncoder(fi)
+	evlock.Unlock()
+	return nil
+}
+
+// CloseEventLog closes the event log, if there is one
+func CloseEventLog() {
+	evlock.Lock()
+	defer evlock.Unlock()
+	if evlog != nil {
+		evlog.Close()
+		evlog = nil
+		evenc = nil
+	}
+}
+
+// SubscribeEvents returns a channel that receives every event from now
+// on, and a func to unsubscribe. Slow subscribers miss events rather
+// than holding up the run.
+func SubscribeEvents() (<-chan *Event, func()) {
+	ch := make(chan *Event, 256)
+	evlock.Lock()
+	evsubs[ch] = struct{}{}
+	evlock.Unlock()
+
+	return ch, func() {
+		evlock.Lock()
+		delete(evsubs, ch)
+		evlock.Unlock()
+	}
+}
+
+// eventsEnabled returns whether anyone is listening for events
+func eventsEnabled() bool {
+	evlock.Lock()
+	defer evlock.Unlock()
+	return evenc != nil || len(evsubs) > 0
+}
+
+// Emit stamps the event, appends it to the event log and passes it on to
+// every subscriber
+func Emit(ev *Event) {
+	evlock.Lock()
+	defer evlock.Unlock()
+	if evenc == nil && len(evsubs) == 0 {
+		return
+	}
+
+	evseq++
+	ev.Seq = evseq
+	ev.Time = time.Now()
+	ev.T = ev.Time.Sub(runStart)
+	if ev.Peer == "" && ev.Node >= 0 && ev.Node < len(configs) {
+		ev.Peer = configs[ev.Node].Identity.PeerID
+	}
+	if evenc != nil {
+		if err := evenc.Encode(ev); err != nil {
+			fmt.Printf("Error writing event: %s\n", err)
+		}
+	}
+	for ch := range evsubs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// NodeIndex returns the index of the node with the given peer ID, or -1
+// if it isnt one of ours
+func NodeIndex(p peer.ID) int {
+	return nodeIndexByID(p.Pretty())
+}
+
+func nodeIndexByID(id string) int {
+	for i, c := range configs {
+		if c.Identity.PeerID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// nodeRef returns a reference to the node index for an event, or nil
+// for peers outside the harness
+func nodeRef(i int) *int {
+	if i < 0 {
+		return nil
+	}
+	return &i
+}
+
+// emitQueryEvent logs a dht query event seen by the given node
+func emitQueryEvent(idex int, qe *notif.QueryEvent) {
+	ev := &Event{
+		Node:       idex,
+		Remote:     qe.ID.Pretty(),
+		RemoteNode: nodeRef(NodeIndex(qe.ID)),
+	}
+	switch qe.Type {
+	case notif.SendingQuery:
+		ev.Type = EvDhtQuery
+	case notif.PeerResponse:
+		ev.Type = EvDhtResponse
+	case notif.QueryError:
+		ev.Type = EvDhtError
+		ev.Error = qe.Extra
+	default:
+		ev.Type = EvDhtFound
+	}
+	Emit(ev)
+}
+
+// connNotifiee logs connections opening and closing on a node
+type connNotifiee struct {
+	node int
+}
+
+func (cn *connNotifiee) Connected(n inet.Network, c inet.Conn) {
+	cn.emit(EvConnOpen, c)
+}
+
+func (cn *connNotifiee) Disconnected(n inet.Network, c inet.Conn) {
+	cn.emit(EvConnClose, c)
+}
+
+func (cn *connNotifiee) emit(typ string, c inet.Conn) {
+	Emit(&Event{
+		Type:       typ,
+		Node:       cn.node,
+		Remote:     c.RemotePeer().Pretty(),
+		RemoteNode: nodeRef(NodeIndex(c.RemotePeer())),
+	})
+}
+
+func (cn *connNotifiee) Listen(inet.Network, ma.Multiaddr)      {}
+func (cn *connNotifiee) ListenClose(inet.Network, ma.Multiaddr) {}
+func (cn *connNotifiee) OpenedStream(inet.Network, inet.Stream) {}
+func (cn *connNotifiee) ClosedStream(inet.Network, inet.Stream) {}
@@ -2,8 +2,15 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/jbenet/go-ipfs/util"
 )
@@ -14,25 +21,257 @@ func init() {
 	files = make(map[string]*FileInfo)
 }
 
+// files and trees are made and used by scripts, the web panel and the
+// api all at once. filesLk guards both maps, along with the fields that
+// adding sets on the files and trees in them.
+var filesLk sync.RWMutex
+
+func getFile(name string) (*FileInfo, bool) {
+	filesLk.RLock()
+	defer filesLk.RUnlock()
+	f, ok := files[name]
+	return f, ok
+}
+
+func putFile(fi *FileInfo) {
+	filesLk.Lock()
+	files[fi.Name] = fi
+	filesLk.Unlock()
+}
+
+var ErrContentMismatch = errors.New("content doesnt match the original")
+
+// maxMemorySize is the largest file held in memory, anything larger has
+// to be made or loaded with 'stream'
+const maxMemorySize = 1 << 30
+
+func errTooLarge(size int64) error {
+	return fmt.Errorf("%d bytes is too large to hold in memory, use 'stream'", size)
+}
+
 type FileInfo struct {
-	Name    string
-	Data    []byte
+	Name string
+	Data []byte
+
+	// the key the file is read back through, empty until it is added
 	RootKey util.Key
+
+	// how the content was generated, and the seed that regenerates it
+	Gen  *GenSpec
+	Seed int64
+
+	// sha256 of the whole file, for generated files
+	Digest []byte
+
+	// the chunker RootKey was added with, and the leaf chunks and
+	// total blocks of the dag it gave, with their keys
+	Chunker string
+	Chunks  int
+	Blocks  int
+	keys    []util.Key
+
+	// files loaded with 'stream' are read from Path whenever they are
+	// needed instead of being held in Data, generated files made with
+	// 'stream' are regenerated from their seed
+	Path   string
+	Stream bool
+	size   int64
+}
+
+// root returns RootKey, for callers not holding filesLk
+func (fi *FileInfo) root() util.Key {
+	filesLk.RLock()
+	defer filesLk.RUnlock()
+	return fi.RootKey
 }
 
-func (fi *FileInfo) GetReader() io.Reader {
-	return bytes.NewReader(fi.Data)
+// Size returns the length of the file in bytes
+func (fi *FileInfo) Size() int64 {
+	if fi.Path != "" || fi.Stream {
+		return fi.size
+	}
+	return int64(len(fi.Data))
+}
+
+// Open returns a reader over the contents of the file
+func (fi *FileInfo) Open() (io.ReadCloser, error) {
+	switch {
+	case fi.Path != "":
+		return os.Open(fi.Path)
+	case fi.Stream:
+		r, err := fi.Gen.NewReader(fi.Seed)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(io.LimitReader(r, fi.size)), nil
+	default:
+		return ioutil.NopCloser(bytes.NewReader(fi.Data)), nil
+	}
 }
 
-func NewFile(name string, size int64) *FileInfo {
-	read := io.LimitReader(util.NewTimeSeededRand(), size)
-	data, err := ioutil.ReadAll(read)
+// OpenAt returns a reader over the contents of the file from offset on
+func (fi *FileInfo) OpenAt(offset int64) (io.ReadCloser, error) {
+	switch {
+	case fi.Path != "":
+		f, err := os.Open(fi.Path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Seek(offset, 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	case fi.Stream:
+		// generators cant seek, so the start is generated and dropped
+		r, err := fi.Open()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, offset); err != nil {
+			r.Close()
+			return nil, err
+		}
+		return r, nil
+	default:
+		return ioutil.NopCloser(bytes.NewReader(fi.Data[offset:])), nil
+	}
+}
+
+// MakeFile creates a file from the arguments of '@name make':
+//
+//	size [generator opt=val...] [seed=N] [stream]
+//
+// Streamed files are regenerated from their seed whenever they are
+// needed instead of being held in memory.
+func MakeFile(name string, args []string) (*FileInfo, error) {
+	if len(args) == 0 {
+		return nil, errors.New("make: no size given")
+	}
+	size, err := ParseSize(args[0])
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	fi := &FileInfo{Name: name, Seed: fileSeed(name), size: size}
+	var genargs []string
+	for _, a := range args[1:] {
+		switch {
+		case a == "stream":
+			fi.Stream = true
+		case strings.HasPrefix(a, "seed="):
+			fi.Seed, err = strconv.ParseInt(a[len("seed="):], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			genargs = append(genargs, a)
+		}
 	}
+	if !fi.Stream && size > maxMemorySize {
+		return nil, errTooLarge(size)
+	}
+	fi.Gen, err = ParseGenSpec(genargs)
+	if err != nil {
+		return nil, err
+	}
+	if err := fi.Gen.bind(); err != nil {
+		return nil, err
+	}
+
+	// one pass over the content to take its digest, which is all that
+	// is kept of streamed files
+	r, err := fi.Gen.NewReader(fi.Seed)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	var w io.Writer = h
+	var buf bytes.Buffer
+	if !fi.Stream {
+		buf.Grow(int(size))
+		w = io.MultiWriter(h, &buf)
+	}
+	if _, err := io.CopyN(w, r, size); err != nil {
+		return nil, err
+	}
+	fi.Digest = h.Sum(nil)
+	if !fi.Stream {
+		fi.Data = buf.Bytes()
+	}
+	return fi, nil
+}
+
+// MakeCmd returns the '@name make' line that makes this file again
+func (fi *FileInfo) MakeCmd() string {
+	cmd := fmt.Sprintf("@%s make %d %s seed=%d", fi.Name, fi.Size(), fi.Gen, fi.Seed)
+	if fi.Stream {
+		cmd += " stream"
+	}
+	return cmd
+}
+
+// checkDigest reads got to the end, checking it against the digest of
+// the whole file, and returns the number of bytes read
+func (fi *FileInfo) checkDigest(got io.Reader) (int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, got)
+	if err != nil {
+		return n, err
+	}
+	if n != fi.Size() || !bytes.Equal(h.Sum(nil), fi.Digest) {
+		return n, ErrContentMismatch
+	}
+	return n, nil
+}
+
+// compareContent reads both readers to the end, failing at the first
+// difference, and returns the number of bytes read from got
+func compareContent(got, want io.Reader) (int64, error) {
+	gbuf := make([]byte, 64*1024)
+	wbuf := make([]byte, len(gbuf))
+	var total int64
+	for {
+		n, gerr := io.ReadFull(got, gbuf)
+		if gerr != nil && gerr != io.EOF && gerr != io.ErrUnexpectedEOF {
+			return total, gerr
+		}
+		if _, err := io.ReadFull(want, wbuf[:n]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return total, ErrContentMismatch
+			}
+			return total, err
+		}
+		if !bytes.Equal(gbuf[:n], wbuf[:n]) {
+			return total, ErrContentMismatch
+		}
+		total += int64(n)
+
+		if gerr != nil {
+			// got has ended, so must want
+			if m, _ := want.Read(wbuf[:1]); m > 0 {
+				return total, ErrContentMismatch
+			}
+			return total, nil
+		}
+	}
+}
+
+// chunkReader reads the chunks sent on ch, ending when it is closed
+type chunkReader struct {
+	ch  <-chan []byte
+	cur []byte
+}
 
-	return &FileInfo{
-		Name: name,
-		Data: data,
+func (cr *chunkReader) Read(b []byte) (int, error) {
+	for len(cr.cur) == 0 {
+		c, ok := <-cr.ch
+		if !ok {
+			return 0, io.EOF
+		}
+		cr.cur = c
 	}
+	n := copy(b, cr.cur)
+	cr.cur = cr.cur[n:]
+	return n, nil
 }
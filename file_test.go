@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReadRange(t *testing.T) {
+	f := &FileInfo{Data: make([]byte, 1000)}
+	tests := []struct {
+		opts           []string
+		offset, length int64
+		ranged         bool
+		ok             bool
+	}{
+		{nil, 0, 1000, false, true},
+		{[]string{"offset=100"}, 100, 900, false, true},
+		{[]string{"length=100"}, 0, 100, true, true},
+		{[]string{"offset=100", "length=50"}, 100, 50, true, true},
+		{[]string{"length=50", "offset=100"}, 100, 50, true, true},
+		{[]string{"offset=1000"}, 1000, 0, false, true},
+		{[]string{"offset=900", "length=500"}, 900, 100, true, true},
+		{[]string{"length=0"}, 0, 0, true, true},
+
+		{[]string{"offset=1001"}, 0, 0, false, false},
+		{[]string{"offset=1KB", "length=1"}, 0, 0, false, false},
+		{[]string{"offset=-1"}, 0, 0, false, false},
+		{[]string{"offset"}, 0, 0, false, false},
+		{[]string{"start=10"}, 0, 0, false, false},
+		{[]string{"length=lots"}, 0, 0, false, false},
+	}
+	for _, tt := range tests {
+		offset, length, ranged, err := readRange(f, tt.opts)
+		if (err == nil) != tt.ok {
+			t.Errorf("readRange(%q): error %v", tt.opts, err)
+			continue
+		}
+		if err == nil && (offset != tt.offset || length != tt.length || ranged != tt.ranged) {
+			t.Errorf("readRange(%q) = %d, %d, %t, want %d, %d, %t", tt.opts, offset, length, ranged, tt.offset, tt.length, tt.ranged)
+		}
+	}
+}
+
+func TestOpenAt(t *testing.T) {
+	gs, err := ParseGenSpec([]string{"text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := gs.Generate(7, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempFile("", "dhthell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Write(want)
+	tmp.Close()
+
+	for _, fi := range []*FileInfo{
+		{Name: "data", Data: want},
+		{Name: "path", Path: tmp.Name(), size: int64(len(want))},
+		{Name: "stream", Stream: true, Gen: gs, Seed: 7, size: int64(len(want))},
+	} {
+		for _, offset := range []int64{0, 1, 65536, int64(len(want))} {
+			r, err := fi.OpenAt(offset)
+			if err != nil {
+				t.Fatalf("%s at %d: %s", fi.Name, offset, err)
+			}
+			got, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(got, want[offset:]) {
+				t.Errorf("%s at %d: wrong content", fi.Name, offset)
+			}
+		}
+	}
+}
+
+func TestChunkReader(t *testing.T) {
+	ch := make(chan []byte, 3)
+	ch <- []byte("dht")
+	ch <- nil
+	ch <- []byte("Hell")
+	close(ch)
+	got, err := ioutil.ReadAll(&chunkReader{ch: ch})
+	if err != nil || string(got) != "dhtHell" {
+		t.Errorf("read %q, %v", got, err)
+	}
+}
+
+// failingReader fails with err where r ends
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (fr *failingReader) Read(b []byte) (int, error) {
+	n, err := fr.r.Read(b)
+	if err == io.EOF {
+		err = fr.err
+	}
+	return n, err
+}
+
+func TestCompareContent(t *testing.T) {
+	big := bytes.Repeat([]byte("dhtHell "), 20000)
+	changed := append([]byte(nil), big...)
+	changed[100000] ^= 1
+
+	tests := []struct {
+		name      string
+		got, want []byte
+		err       error
+	}{
+		{"equal", big, big, nil},
+		{"empty", nil, nil, nil},
+		{"differs", changed, big, ErrContentMismatch},
+		{"short", big[:len(big)-1], big, ErrContentMismatch},
+		{"long", big, big[:len(big)-1], ErrContentMismatch},
+		{"long past a buffer", big, big[:1000], ErrContentMismatch},
+		{"empty got", nil, big, ErrContentMismatch},
+		{"empty want", big, nil, ErrContentMismatch},
+	}
+	for _, tt := range tests {
+		n, err := compareContent(bytes.NewReader(tt.got), bytes.NewReader(tt.want))
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		}
+		if err == nil && n != int64(len(tt.got)) {
+			t.Errorf("%s: read %d bytes, want %d", tt.name, n, len(tt.got))
+		}
+	}
+
+	// errors reading either side are passed on
+	broken := errors.New("broken")
+	_, err := compareContent(&failingReader{strings.NewReader("abc"), broken}, strings.NewReader("abcdef"))
+	if err != broken {
+		t.Errorf("error reading got: %v", err)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jbenet/go-ipfs/util"
+)
+
+// DataType is the shape of the content of a generated file
+type DataType int
+
+const (
+	DataRandom DataType = iota
+	DataZeros
+	DataPattern
+	DataText
+	DataCompressible
+	DataDuplicate
+)
+
+var dataTypeNames = map[string]DataType{
+	"random":   DataRandom,
+	"zeros":    DataZeros,
+	"pattern":  DataPattern,
+	"text":     DataText,
+	"compress": DataCompressible,
+	"dup":      DataDuplicate,
+}
+
+func (dt DataType) String() string {
+	for name, t := range dataTypeNames {
+		if t == dt {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// size of the runs compressible data is built from
+const compressBlock = 4096
+
+var sizeUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// ParseSize reads a byte count, optionally with a B, KB, MB or GB suffix
+// (powers of 1024)
+func ParseSize(s string) (int64, error) {
+	num, mult := strings.ToUpper(s), int64(1)
+	for _, su := range sizeUnits {
+		if strings.HasSuffix(num, su.suffix) {
+			num, mult = num[:len(num)-len(su.suffix)], su.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("bad size '%s'", s)
+	}
+	// float64 cant hold MaxInt64 exactly, so the bound itself is out
+	if n >= float64(math.MaxInt64/mult) {
+		return 0, fmt.Errorf("size '%s' is too large", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// GenSpec describes how to generate the content of a file
+type GenSpec struct {
+	Type DataType
+
+	// repeated by DataPattern
+	Pattern []byte
+
+	// compressed size over original size, for DataCompressible
+	Ratio float64
+
+	// DataDuplicate copies each Chunk sized chunk of the file named Of
+	// with probability Share, the rest is random
+	Of    string
+	Share float64
+	Chunk int64
+
+	// the content of Of when this file was made, so redefining or
+	// deleting it later doesnt change ours
+	src []byte
+}
+
+// bind captures the content a generator copies from. It is done once,
+// when the file is made.
+func (gs *GenSpec) bind() error {
+	if gs.Type != DataDuplicate {
+		return nil
+	}
+	src, ok := getFile(gs.Of)
+	if !ok || len(src.Data) == 0 {
+		return fmt.Errorf("dup: no file '%s' in memory to share chunks with", gs.Of)
+	}
+	gs.src = src.Data
+	return nil
+}
+
+func (gs *GenSpec) String() string {
+	switch gs.Type {
+	case DataPattern:
+		return fmt.Sprintf("pattern pat=%s", gs.Pattern)
+	case DataCompressible:
+		return fmt.Sprintf("compress ratio=%g", gs.Ratio)
+	case DataDuplicate:
+		return fmt.Sprintf("dup of=%s share=%g chunk=%d", gs.Of, gs.Share, gs.Chunk)
+	default:
+		return gs.Type.String()
+	}
+}
+
+// ParseGenSpec reads a generator name followed by its key=value
+// options, for example 'dup of=base share=0.8'. No arguments at all
+// means random data.
+func ParseGenSpec(args []string) (*GenSpec, error) {
+	gs := &GenSpec{
+		Type:    DataRandom,
+		Pattern: []byte("dhtHell"),
+		Ratio:   0.5,
+		Share:   0.5,
+		Chunk:   256 * 1024,
+	}
+	if len(args) == 0 {
+		return gs, nil
+	}
+
+	t, ok := dataTypeNames[args[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown generator '%s'", args[0])
+	}
+	gs.Type = t
+
+	for _, opt := range args[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("generator options are key=value, got '%s'", opt)
+		}
+		var err error
+		switch kv[0] {
+		case "pat":
+			gs.Pattern = []byte(kv[1])
+		case "ratio":
+			gs.Ratio, err = strconv.ParseFloat(kv[1], 64)
+		case "of":
+			gs.Of = kv[1]
+		case "share":
+			gs.Share, err = strconv.ParseFloat(kv[1], 64)
+		case "chunk":
+			gs.Chunk, err = ParseSize(kv[1])
+		default:
+			return nil, fmt.Errorf("unknown generator option '%s'", kv[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case gs.Type == DataPattern && len(gs.Pattern) == 0:
+		return nil, errors.New("pattern: empty pattern")
+	case gs.Type == DataCompressible && (gs.Ratio <= 0 || gs.Ratio > 1):
+		return nil, errors.New("compress: ratio must be in (0, 1]")
+	case gs.Type == DataDuplicate && gs.Of == "":
+		return nil, errors.New("dup: 'of=file' is required")
+	case gs.Type == DataDuplicate && (gs.Share < 0 || gs.Share > 1):
+		return nil, errors.New("dup: share must be in [0, 1]")
+	case gs.Type == DataDuplicate && gs.Chunk <= 0:
+		return nil, errors.New("dup: chunk must be positive")
+	case gs.Type == DataDuplicate && gs.Chunk > maxMemorySize:
+		return nil, fmt.Errorf("dup: chunk must be at most %d bytes", maxMemorySize)
+	}
+	return gs, nil
+}
+
+// Generate produces size bytes of content in the shape described,
+// the same every time for the same seed
+func (gs *GenSpec) Generate(seed, size int64) ([]byte, error) {
+	r, err := gs.NewReader(seed)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// NewReader returns an endless stream of content in the shape
+// described, the same every time for the same seed
+func (gs *GenSpec) NewReader(seed int64) (io.Reader, error) {
+	rnd := util.NewSeededRand(seed)
+	pick := rand.New(rand.NewSource(seed))
+	gr := &genReader{}
+
+	switch gs.Type {
+	case DataRandom:
+		return rnd, nil
+
+	case DataZeros:
+		zeros := make([]byte, compressBlock)
+		gr.next = func() ([]byte, error) { return zeros, nil }
+
+	case DataPattern:
+		gr.next = func() ([]byte, error) { return gs.Pattern, nil }
+
+	case DataText:
+		gr.next = func() ([]byte, error) { return textLine(pick), nil }
+
+	case DataCompressible:
+		// each block is random up to the ratio and zeros after it
+		rlen := int(float64(compressBlock) * gs.Ratio)
+		gr.next = func() ([]byte, error) {
+			blk := make([]byte, compressBlock)
+			_, err := io.ReadFull(rnd, blk[:rlen])
+			return blk, err
+		}
+
+	case DataDuplicate:
+		if gs.src == nil {
+			return nil, errors.New("dup: the file to share chunks with wasnt bound")
+		}
+		srcChunks := (int64(len(gs.src)) + gs.Chunk - 1) / gs.Chunk
+		var chunkIdx int64
+		gr.next = func() ([]byte, error) {
+			blk := make([]byte, gs.Chunk)
+			if _, err := io.ReadFull(rnd, blk); err != nil {
+				return nil, err
+			}
+			if pick.Float64() < gs.Share {
+				// chunks line up with the source, wrapping around it.
+				// its last chunk may be short, leaving random data
+				// at the end of ours.
+				copy(blk, gs.src[(chunkIdx%srcChunks)*gs.Chunk:])
+			}
+			chunkIdx++
+			return blk, nil
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown data type %d", gs.Type)
+	}
+	return gr, nil
+}
+
+// genReader reads through the blocks produced by next, one after
+// another
+type genReader struct {
+	next    func() ([]byte, error)
+	pending []byte
+}
+
+func (gr *genReader) Read(b []byte) (int, error) {
+	for len(gr.pending) == 0 {
+		blk, err := gr.next()
+		if err != nil {
+			return 0, err
+		}
+		gr.pending = blk
+	}
+	n := copy(b, gr.pending)
+	gr.pending = gr.pending[n:]
+	return n, nil
+}
+
+// fileSeed picks the seed for a generated file that wasnt given one.
+// Runs with -seed generate the same files every time.
+func fileSeed(name string) int64 {
+	if identitySeed == 0 {
+		return time.Now().UnixNano()
+	}
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return identitySeed ^ int64(h.Sum64())
+}
+
+var textWords = strings.Fields(`the of and to in is that for it as was with be by on
+not he this are or his from at which but have an they you were her she
+there one all we their been has when who will more no if out so said
+what up its about into than them can only other new some could time
+these two may then do first any my now such like our over man me even
+most made after also did many before must through back years where much
+your way well down should because each just those people how too little
+state good very make world still own see men work long get here between
+both life being under never day same another know while last might us
+great old year off come since against go came right used take three
+distributed hash table peer node key value provider block record`)
+
+// textLine builds a line of english looking text out of common words
+func textLine(r *rand.Rand) []byte {
+	var line bytes.Buffer
+	for {
+		w := textWords[r.Intn(len(textWords))]
+		if line.Len()+len(w) >= 72 {
+			line.WriteByte('\n')
+			return line.Bytes()
+		}
+		if line.Len() > 0 {
+			line.WriteByte(' ')
+		}
+		line.WriteString(w)
+	}
+}
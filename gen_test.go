@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"1024", 1024, true},
+		{"10B", 10, true},
+		{"1KB", 1 << 10, true},
+		{"1kb", 1 << 10, true},
+		{"1.5MB", 3 << 19, true},
+		{"2GB", 2 << 30, true},
+		{"256KB", 256 << 10, true},
+		{"", 0, false},
+		{"KB", 0, false},
+		{"-1", 0, false},
+		{"-1KB", 0, false},
+		{"lots", 0, false},
+		{"1TB", 0, false},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"-Inf", 0, false},
+		{"9223372036854775807", 0, false},
+		{"1e30", 0, false},
+		{"8589934592GB", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseSize(%q): error %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseGenSpec(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+		ok   bool
+	}{
+		{nil, "random", true},
+		{[]string{"zeros"}, "zeros", true},
+		{[]string{"text"}, "text", true},
+		{[]string{"pattern", "pat=ab"}, "pattern pat=ab", true},
+		{[]string{"compress"}, "compress ratio=0.5", true},
+		{[]string{"compress", "ratio=1"}, "compress ratio=1", true},
+		{[]string{"dup", "of=base"}, "dup of=base share=0.5 chunk=262144", true},
+		{[]string{"dup", "of=base", "share=1", "chunk=4KB"}, "dup of=base share=1 chunk=4096", true},
+
+		{[]string{"bogus"}, "", false},
+		{[]string{"random", "foo"}, "", false},
+		{[]string{"random", "foo=1"}, "", false},
+		{[]string{"pattern", "pat="}, "", false},
+		{[]string{"compress", "ratio=0"}, "", false},
+		{[]string{"compress", "ratio=1.5"}, "", false},
+		{[]string{"compress", "ratio=half"}, "", false},
+		{[]string{"dup"}, "", false},
+		{[]string{"dup", "of=base", "share=1.5"}, "", false},
+		{[]string{"dup", "of=base", "share=-0.1"}, "", false},
+		{[]string{"dup", "of=base", "chunk=0"}, "", false},
+		{[]string{"dup", "of=base", "chunk=2GB"}, "", false},
+	}
+	for _, tt := range tests {
+		gs, err := ParseGenSpec(tt.args)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseGenSpec(%q): error %v", tt.args, err)
+			continue
+		}
+		if err == nil && gs.String() != tt.want {
+			t.Errorf("ParseGenSpec(%q) = %q, want %q", tt.args, gs, tt.want)
+		}
+	}
+}
+
+func TestGenerateIsSeeded(t *testing.T) {
+	for name := range dataTypeNames {
+		if name == "dup" {
+			continue
+		}
+		gs, err := ParseGenSpec([]string{name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := gs.Generate(42, 10000)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		b, _ := gs.Generate(42, 10000)
+		if !bytes.Equal(a, b) {
+			t.Errorf("%s: same seed generated different content", name)
+		}
+	}
+}
+
+func TestDupKeepsItsSource(t *testing.T) {
+	defer func(old map[string]*FileInfo) { files = old }(files)
+	files = make(map[string]*FileInfo)
+
+	base, err := MakeFile("base", []string{"64KB", "seed=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putFile(base)
+	f, err := MakeFile("f", []string{"256KB", "dup", "of=base", "share=1", "chunk=4KB", "stream", "seed=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// redefining the source and then deleting it leaves f as it was
+	other, err := MakeFile("base", []string{"64KB", "seed=3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putFile(other)
+	for i := 0; i < 2; i++ {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.checkDigest(r); err != nil {
+			t.Errorf("read %d: %s", i, err)
+		}
+		delete(files, "base")
+	}
+}
+
+func TestMakeFileTooLarge(t *testing.T) {
+	if _, err := MakeFile("big", []string{"8GB"}); err == nil {
+		t.Error("made an 8GB file in memory")
+	}
+}
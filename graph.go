@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+)
+
+// GraphNode is a vertex of the network graph sent to the visualization
+type GraphNode struct {
+	Name  string `json:"name"`
+	Num   int    `json:"num"` // node index, -1 for peers outside the harness
+	Value int    `json:"value"`
+	Group int    `json:"group"`
+	State string `json:"state"`
+
+	// dead nodes are still drawn, as ghosts
+	Dead bool `json:"dead,omitempty"`
+}
+
+// GraphLink is a connection between two vertices
+type GraphLink struct {
+	Source int `json:"source"`
+	Target int `json:"target"`
+	Value  int `json:"value"`
+}
+
+// Graph is the network as the d3 force layout wants it
+type Graph struct {
+	Nodes []*GraphNode `json:"nodes"`
+	Links []*GraphLink `json:"links"`
+}
+
+type graphBuilder struct {
+	g      *Graph
+	byName map[string]int
+	links  map[[2]int]bool
+	groups map[int]int
+}
+
+func newGraphBuilder() *graphBuilder {
+	gb := &graphBuilder{
+		g:      new(Graph),
+		byName: make(map[string]int),
+		links:  make(map[[2]int]bool),
+		groups: make(map[int]int),
+	}
+
+	// colour nodes by the first group they are in, in name order
+	var names []string
+	for name := range nodeGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for gi, name := range names {
+		for _, i := range nodeGroups[name] {
+			if _, ok := gb.groups[i]; !ok {
+				gb.groups[i] = gi + 1
+			}
+		}
+	}
+	return gb
+}
+
+// vertex returns the graph index of the given peer, adding it if needed
+func (gb *graphBuilder) vertex(name string) int {
+	if v, ok := gb.byName[name]; ok {
+		return v
+	}
+
+	gn := &GraphNode{Name: name, Num: nodeIndexByID(name), Value: 1, State: "external"}
+	if gn.Num >= 0 {
+		gn.State = nodeState(gn.Num)
+		gn.Dead = gn.State != "running"
+		gn.Group = gb.groups[gn.Num]
+	}
+	gb.byName[name] = len(gb.g.Nodes)
+	gb.g.Nodes = append(gb.g.Nodes, gn)
+	return gb.byName[name]
+}
+
+func (gb *graphBuilder) link(a, b int) {
+	if a > b {
+		a, b = b, a
+	}
+	if a == b || gb.links[[2]int{a, b}] {
+		return
+	}
+	gb.links[[2]int{a, b}] = true
+	gb.g.Links = append(gb.g.Links, &GraphLink{Source: a, Target: b, Value: 1})
+}
+
+// addNode adds a harness node along with all of its connections
+func (gb *graphBuilder) addNode(i int) {
+	self := gb.vertex(configs[i].Identity.PeerID)
+	c := controller(i)
+	if controllerState(c) != "running" {
+		return
+	}
+
+	peers := c.Peers()
+	gb.g.Nodes[self].Value = len(peers) + 1
+	for _, p := range peers {
+		gb.link(self, gb.vertex(p.Pretty()))
+	}
+}
+
+// BuildGraph builds the network graph straight from every in process
+// node's connections. A view of -1 gives the union of all of them,
+// otherwise just the given node and its connections.
+func BuildGraph(view int) *Graph {
+	gb := newGraphBuilder()
+	if view >= 0 {
+		gb.addNode(view)
+		return gb.g
+	}
+	for i := 0; i < numNodes(); i++ {
+		gb.addNode(i)
+	}
+	return gb.g
+}
+
+// parseView reads the 'view' query parameter: a node index, or 'all'
+func parseView(s string) (int, error) {
+	if s == "" || s == "all" {
+		return -1, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 || i >= numNodes() {
+		return 0, strconv.ErrRange
+	}
+	return i, nil
+}
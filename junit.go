@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"sync"
+	"time"
+)
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr"`
+	Line      int           `xml:"line,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     float64     `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+var assertlk sync.Mutex
+var assertions []junitCase
+
+// RecordAssertion records the outcome of an expectation, or any other
+// check made by a script, as a test case
+func RecordAssertion(name string, pos ScriptPos, took time.Duration, err error) {
+	tc := junitCase{
+		Name:      name,
+		Classname: pos.File,
+		File:      pos.File,
+		Line:      pos.Line,
+		Time:      took.Seconds(),
+	}
+	if err != nil {
+		tc.Failure = &junitFailure{
+			Message: err.Error(),
+			Text:    pos.String() + ": " + name + ": " + err.Error(),
+		}
+	}
+
+	assertlk.Lock()
+	assertions = append(assertions, tc)
+	assertlk.Unlock()
+}
+
+// WriteJUnit writes every recorded assertion to the given file as a
+// junit xml test suite
+func WriteJUnit(path string) error {
+	assertlk.Lock()
+	suite := junitSuite{
+		Name:  "dhtHell",
+		Tests: len(assertions),
+		Cases: assertions,
+	}
+	for _, tc := range assertions {
+		suite.Time += tc.Time
+		if tc.Failure != nil {
+			suite.Failures++
+		}
+	}
+	b, err := xml.MarshalIndent(suite, "", "\t")
+	assertlk.Unlock()
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	if _, err := fi.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	if _, err := fi.Write(b); err != nil {
+		return err
+	}
+	_, err = fi.Write([]byte("\n"))
+	return err
+}
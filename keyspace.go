@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/context"
+	ggio "code.google.com/p/gogoprotobuf/io"
+
+	"github.com/jbenet/go-ipfs/p2p/host"
+	inet "github.com/jbenet/go-ipfs/p2p/net"
+	peer "github.com/jbenet/go-ipfs/p2p/peer"
+	dht "github.com/jbenet/go-ipfs/routing/dht"
+	dhtpb "github.com/jbenet/go-ipfs/routing/dht/pb"
+	kb "github.com/jbenet/go-ipfs/routing/kbucket"
+	u "github.com/jbenet/go-ipfs/util"
+)
+
+// how many closest peers to highlight when not told otherwise
+const defaultK = 20
+
+// KeyspaceEntry places a node in the xor keyspace relative to a key
+type KeyspaceEntry struct {
+	Node  int    `json:"node"`
+	Peer  string `json:"peer"`
+	State string `json:"state"`
+
+	// position on the keyspace ring, from 0 to 1
+	Pos float64 `json:"pos"`
+
+	// xor distance to the key, and the number of leading bits the
+	// node shares with it
+	Distance     string `json:"distance"`
+	CommonPrefix int    `json:"common_prefix"`
+
+	Rank    int  `json:"rank"`
+	Closest bool `json:"closest"`
+
+	HasValue bool `json:"has_value"`
+
+	// the nodes this one holds provider records for, and why they
+	// couldnt be asked for if they couldnt
+	HasProvider   bool   `json:"has_provider"`
+	Providers     []int  `json:"providers,omitempty"`
+	ProviderError string `json:"provider_error,omitempty"`
+
+	dist []byte
+}
+
+// Keyspace is every node sorted by xor distance to a key
+type Keyspace struct {
+	Key     string           `json:"key"`
+	Pos     float64          `json:"pos"`
+	K       int              `json:"k"`
+	Entries []*KeyspaceEntry `json:"entries"`
+}
+
+// ringPos maps a kademlia id onto [0, 1) by its leading 64 bits
+func ringPos(id kb.ID) float64 {
+	return float64(binary.BigEndian.Uint64(id[:8])) / (1 << 64)
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+func commonPrefixLen(dist []byte) int {
+	for i, b := range dist {
+		for j := 0; j < 8; j++ {
+			if b&(0x80>>uint(j)) != 0 {
+				return i*8 + j
+			}
+		}
+	}
+	return len(dist) * 8
+}
+
+type byDistance []*KeyspaceEntry
+
+func (d byDistance) Len() int           { return len(d) }
+func (d byDistance) Less(i, j int) bool { return bytes.Compare(d[i].dist, d[j].dist) < 0 }
+func (d byDistance) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// how long a node gets to say which provider records it holds
+const providerTimeout = time.Second * 5
+
+// askProviders asks the dht of peer p which provider records it holds
+// for k. The dht has no way to read its provider store from outside,
+// but it answers a GET_PROVIDERS message from another peer straight out
+// of it, so that is sent over a stream from h.
+func askProviders(ctx context.Context, h host.Host, p peer.ID, k u.Key) ([]peer.ID, error) {
+	s, err := h.NewStream(dht.ProtocolDHT, p)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	// streams dont take a context, closing it ends a slow read
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-done:
+		}
+	}()
+
+	req := dhtpb.NewMessage(dhtpb.Message_GET_PROVIDERS, string(k), 0)
+	if err := ggio.NewDelimitedWriter(s).WriteMsg(req); err != nil {
+		return nil, err
+	}
+	resp := new(dhtpb.Message)
+	if err := ggio.NewDelimitedReader(s, inet.MessageSizeMax).ReadMsg(resp); err != nil {
+		return nil, err
+	}
+	var provs []peer.ID
+	for _, pi := range dhtpb.PBPeersToPeerInfos(resp.GetProviderPeers()) {
+		provs = append(provs, pi.ID)
+	}
+	return provs, nil
+}
+
+// findProviderRecords asks every running node, through another running
+// node, which provider records it holds for k
+func findProviderRecords(entries []*KeyspaceEntry, k u.Key) {
+	var running []*KeyspaceEntry
+	for _, e := range entries {
+		if e.State == "running" {
+			running = append(running, e)
+		}
+	}
+
+	if len(running) < 2 {
+		for _, e := range running {
+			e.ProviderError = "no other node running to ask it"
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(masterCtx, providerTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i, e := range running {
+		asker := running[(i+1)%len(running)]
+		wg.Add(1)
+		go func(e, asker *KeyspaceEntry) {
+			defer wg.Done()
+			pid, err := peer.IDB58Decode(e.Peer)
+			if err != nil {
+				e.ProviderError = err.Error()
+				return
+			}
+			provs, err := controller(asker.Node).AskProviders(ctx, pid, k)
+			if err != nil {
+				e.ProviderError = err.Error()
+				return
+			}
+			for _, p := range provs {
+				// a node holding the value names itself as a provider
+				// without having a record for it
+				if p == pid && e.HasValue {
+					continue
+				}
+				e.Providers = append(e.Providers, NodeIndex(p))
+			}
+			e.HasProvider = len(e.Providers) > 0
+		}(e, asker)
+	}
+	wg.Wait()
+}
+
+// BuildKeyspace places every node relative to the given key, marking
+// the k closest and the nodes holding its value or provider records
+func BuildKeyspace(key string, k int) *Keyspace {
+	uk := u.Key(key)
+	kid := kb.ConvertKey(uk)
+	ks := &Keyspace{Key: key, Pos: ringPos(kid), K: k}
+
+	for i, cfg := range configs {
+		pid, err := peer.IDB58Decode(cfg.Identity.PeerID)
+		if err != nil {
+			fmt.Printf("bad peer id for node %d: %s\n", i, err)
+			continue
+		}
+		c := controller(i)
+		id := kb.ConvertPeerID(pid)
+		dist := xorBytes(id, kid)
+		e := &KeyspaceEntry{
+			Node:         i,
+			Peer:         cfg.Identity.PeerID,
+			State:        controllerState(c),
+			Pos:          ringPos(id),
+			Distance:     hex.EncodeToString(dist),
+			CommonPrefix: commonPrefixLen(dist),
+			dist:         dist,
+		}
+		if e.State == "running" {
+			e.HasValue = c.HasValue(uk)
+		}
+		ks.Entries = append(ks.Entries, e)
+	}
+	findProviderRecords(ks.Entries, uk)
+
+	sort.Sort(byDistance(ks.Entries))
+	for r, e := range ks.Entries {
+		e.Rank = r + 1
+		e.Closest = r < k
+	}
+	return ks
+}
+
+// PrintKeyspace writes the keyspace around a key as text
+func PrintKeyspace(w io.Writer, ks *Keyspace) {
+	fmt.Fprintf(w, "Keyspace around '%s' (ring position %.4f), %d closest marked with *\n", ks.Key, ks.Pos, ks.K)
+	fmt.Fprintf(w, "\t%4s  %4s %-8s %6s %-7s  %-5s %-9s %s\n", "rank", "node", "state", "pos", "prefix", "value", "providers", "peer")
+	for _, e := range ks.Entries {
+		mark := " "
+		if e.Closest {
+			mark = "*"
+		}
+		fmt.Fprintf(w, "\t%s%3d  %4d %-8s %.4f %3d bits  %-5s %-9s %s\n",
+			mark, e.Rank, e.Node, e.State, e.Pos, e.CommonPrefix, yesNo(e.HasValue), providerList(e), e.Peer)
+	}
+}
+
+// providerList names the nodes an entry holds provider records for, -1
+// being a peer outside the harness
+func providerList(e *KeyspaceEntry) string {
+	switch {
+	case e.ProviderError != "":
+		return "?"
+	case len(e.Providers) == 0:
+		return "-"
+	}
+	var names []string
+	for _, p := range e.Providers {
+		names = append(names, strconv.Itoa(p))
+	}
+	return strings.Join(names, ",")
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// KeyspaceCommand implements 'keyspace key [k]'
+func KeyspaceCommand(w io.Writer, cmdparts []string) error {
+	if len(cmdparts) < 2 {
+		return fmt.Errorf("keyspace: 'keyspace key [k]'")
+	}
+	k := defaultK
+	if len(cmdparts) > 2 {
+		n, err := strconv.Atoi(cmdparts[2])
+		if err != nil {
+			return err
+		}
+		k = n
+	}
+	PrintKeyspace(w, BuildKeyspace(cmdparts[1], k))
+	return nil
+}
+
+// ServeKeyspace returns the keyspace around ?key= as json
+func ServeKeyspace(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "no key given", http.StatusBadRequest)
+		return
+	}
+	k := defaultK
+	if ks := r.URL.Query().Get("k"); ks != "" {
+		n, err := strconv.Atoi(ks)
+		if err != nil {
+			http.Error(w, "bad k", http.StatusBadRequest)
+			return
+		}
+		k = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(BuildKeyspace(key, k)); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+	"github.com/jbenet/go-ipfs/p2p/peer"
+	config "github.com/jbenet/go-ipfs/repo/config"
+)
+
+func TestFindProviderRecords(t *testing.T) {
+	defer func(c []*config.Config, n []NodeController, ctx context.Context) {
+		configs, controllers, masterCtx = c, n, ctx
+	}(configs, controllers, masterCtx)
+	masterCtx = context.Background()
+
+	configs = nil
+	for _, id := range []string{"a", "b", "c"} {
+		cfg := new(config.Config)
+		cfg.Identity.PeerID = id
+		configs = append(configs, cfg)
+	}
+	// every node is asked from the next one, so only those answers count
+	controllers = []NodeController{
+		&fakeNode{alive: true, provs: map[peer.ID][]peer.ID{"c": {"a"}}},
+		&fakeNode{alive: true, provs: map[peer.ID][]peer.ID{"a": {"a", "b"}}},
+		&fakeNode{alive: true, provs: map[peer.ID][]peer.ID{"b": {"x"}}},
+	}
+	entries := []*KeyspaceEntry{
+		{Node: 0, Peer: "a", State: "running", HasValue: true},
+		{Node: 1, Peer: "b", State: "running"},
+		{Node: 2, Peer: "c", State: "running"},
+	}
+	findProviderRecords(entries, "k")
+
+	want := [][]int{{1}, {-1}, {0}}
+	for i, e := range entries {
+		if e.ProviderError != "" {
+			t.Fatalf("node %d: %s", i, e.ProviderError)
+		}
+		if !reflect.DeepEqual(e.Providers, want[i]) || e.HasProvider != (want[i] != nil) {
+			t.Errorf("node %d providers %v, want %v", i, e.Providers, want[i])
+		}
+	}
+
+	// a lone node has nobody to ask it
+	lone := []*KeyspaceEntry{{Node: 0, Peer: "a", State: "running"}, {Node: 1, Peer: "b", State: "dead"}}
+	findProviderRecords(lone, "k")
+	if lone[0].ProviderError == "" || lone[1].ProviderError != "" {
+		t.Errorf("lone node errors %q %q", lone[0].ProviderError, lone[1].ProviderError)
+	}
+}
+
+func TestBuildKeyspaceWhileConfiguring(t *testing.T) {
+	defer func(c []*config.Config, n []NodeController, ctx context.Context) {
+		configs, controllers, masterCtx = c, n, ctx
+	}(configs, controllers, masterCtx)
+	masterCtx = context.Background()
+
+	// a config prompt adds configs before any controller exists
+	configs = nil
+	for _, id := range []string{"a", "b", "c"} {
+		cfg := new(config.Config)
+		cfg.Identity.PeerID = id
+		configs = append(configs, cfg)
+	}
+	controllers = []NodeController{&fakeNode{alive: true}}
+
+	ks := BuildKeyspace("k", 2)
+	states := make(map[int]string)
+	for _, e := range ks.Entries {
+		states[e.Node] = e.State
+	}
+	want := map[int]string{0: "running", 1: "off", 2: "off"}
+	if !reflect.DeepEqual(states, want) {
+		t.Fatalf("states %v, want %v", states, want)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// LoadPath registers the file or directory at path under name, as a
+// file or a tree. Streamed content is read from disk whenever it is
+// needed instead of being held in memory.
+func LoadPath(name, path string, stream bool) (string, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	if !st.IsDir() {
+		fi := &FileInfo{Name: name, Path: path, size: st.Size()}
+		if !stream && st.Size() > maxMemorySize {
+			return "", errTooLarge(st.Size())
+		}
+		if !stream {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+			fi.Data, fi.Path = data, ""
+		}
+		putFile(fi)
+		return fmt.Sprintf("Loaded '%s' from %s (%d bytes)", name, path, fi.Size()), nil
+	}
+
+	ti := &TreeInfo{Name: name, Spec: "load " + path}
+	ti.Root, err = ti.load(name, path, stream)
+	if err != nil {
+		return "", err
+	}
+	putTree(ti)
+	return fmt.Sprintf("Loaded tree '%s' from %s: %d nodes, %d bytes", name, path, ti.Nodes, ti.Size), nil
+}
+
+func (ti *TreeInfo) load(name, path string, stream bool) (*TreeNode, error) {
+	ents, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tn := &TreeNode{Name: name, Dir: true}
+	ti.Nodes++
+	for _, ent := range ents {
+		cpath := filepath.Join(path, ent.Name())
+		switch {
+		case ent.IsDir():
+			c, err := ti.load(ent.Name(), cpath, stream)
+			if err != nil {
+				return nil, err
+			}
+			tn.Children = append(tn.Children, c)
+		case ent.Mode().IsRegular():
+			c := &TreeNode{Name: ent.Name(), Path: cpath}
+			ti.Nodes++
+			ti.Size += ent.Size()
+			// without 'stream' the whole tree is held in memory
+			if !stream && ti.Size > maxMemorySize {
+				return nil, errTooLarge(ti.Size)
+			}
+			if !stream {
+				c.Data, err = ioutil.ReadFile(cpath)
+				if err != nil {
+					return nil, err
+				}
+				c.Path = ""
+			}
+			tn.Children = append(tn.Children, c)
+		default:
+			// symlinks, devices and the like dont go into the tree
+			fmt.Printf("Skipping %s, not a regular file\n", cpath)
+		}
+	}
+	return tn, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTreeTooLarge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dhthell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(trees, "big")
+
+	// neither file is over the limit on its own, but both together are.
+	// the large one is sparse, and never read.
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(maxMemorySize)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadPath("big", dir, false); err == nil {
+		t.Fatal("loaded a tree larger than memory")
+	}
+	if _, ok := getTree("big"); ok {
+		t.Fatal("tree registered after failing to load")
+	}
+	if _, err := LoadPath("big", dir, true); err != nil {
+		t.Fatalf("streamed: %s", err)
+	}
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"io"
 	"os"
-	"runtime/pprof"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,7 +15,6 @@ import (
 
 	"flag"
 
-	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -94,6 +93,18 @@ func ExecConfigLine(s string) bool {
 		for _, v := range rng {
 			disabledAtStart[v] = true
 		}
+	} else if strings.HasPrefix(s, "group") {
+		parts := strings.Split(s, " ")
+		if len(parts) < 3 {
+			fmt.Printf("Syntax error, group needs a name and a range!\n")
+			return false
+		}
+		rng, err := ParseRange(parts[2])
+		if err != nil {
+			fmt.Printf("Syntax error: %s\n", err)
+			return false
+		}
+		nodeGroups[parts[1]] = append(nodeGroups[parts[1]], rng...)
 	} else {
 		fmt.Printf("Invalid Syntax for setup: '%s'\n", s)
 		return false
@@ -101,12 +112,18 @@ func ExecConfigLine(s string) bool {
 	return false
 }
 
-func ParseCommandFile(finame string, cfg *testConfig) (*bufio.Scanner, error) {
+func ParseCommandFile(finame string, cfg *testConfig) (*ScriptScanner, error) {
 	fi, err := os.Open(finame)
 	if err != nil {
 		return nil, err
 	}
-	scan := bufio.NewScanner(fi)
+	return ParseScenario(NewScriptScanner(finame, fi), cfg)
+}
+
+// ParseScenario reads the node count and setup lines of a scenario,
+// returning the scanner positioned at its first command, or nil if the
+// scenario was all setup
+func ParseScenario(scan *ScriptScanner, cfg *testConfig) (*ScriptScanner, error) {
 	if !scan.Scan() {
 		return nil, errors.New("Invalid file syntax! first line must be num nodes")
 	}
@@ -143,7 +160,7 @@ out:
 func SetupNConfigs(c *testConfig) {
 	disabledAtStart = make([]bool, c.NumNodes)
 	for i := 0; i < c.NumNodes; i++ {
-		ncfg := BuildConfig(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", 10000+i))
+		ncfg := BuildConfig(i, fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", 10000+i))
 		if setuprpc {
 			ncfg.Addresses.API = fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", 9000+i)
 		}
@@ -151,7 +168,7 @@ func SetupNConfigs(c *testConfig) {
 	}
 }
 
-func ConfigPrompt(scan *bufio.Scanner) error {
+func ConfigPrompt(scan *ScriptScanner) error {
 	fmt.Println("Please enter number of nodes:")
 	if !scan.Scan() {
 		return errors.New("not enough input!")
@@ -176,15 +193,64 @@ func ConfigPrompt(scan *bufio.Scanner) error {
 	return nil
 }
 
-func SetupNodes(master context.Context) {
+func SetupNodes(master context.Context) error {
+	controllersLk.Lock()
 	controllers = make([]NodeController, len(configs))
-	for i, ncfg := range configs {
+	controllersLk.Unlock()
+	for i := range configs {
 		if !disabledAtStart[i] {
-			nd := nodeFromConfig(master, ncfg)
-			controllers[i] = &localNode{nd}
+			if err := startNode(i); err != nil {
+				return fmt.Errorf("failed to start node %d: %s", i, err)
+			}
 		}
 	}
 	fmt.Println("Finished DHT creation.")
+	return nil
+}
+
+// closed once the network is up, for headless runs waiting on the api
+var networkReady = make(chan struct{})
+
+// held from configuring a network until it is up, by the main loop and
+// by the api, so only one of them ever builds it, and read locked to
+// describe it. networkUp is set once it has been.
+var networkLk sync.RWMutex
+var networkUp bool
+
+var ErrNetworkUp = errors.New("a network already exists")
+
+// startNetwork builds every configured node and announces the run, the
+// caller must hold networkLk. If a node fails to start the nodes and
+// their configuration are thrown away, so another can be tried.
+func startNetwork(ctx context.Context) error {
+	if networkUp {
+		return ErrNetworkUp
+	}
+	if err := SetupNodes(ctx); err != nil {
+		resetNetwork()
+		return err
+	}
+	networkUp = true
+	Emit(&Event{Type: EvRunStart, Node: -1, Setup: CurrentSetup()})
+	close(networkReady)
+	return nil
+}
+
+// resetNetwork closes any nodes already built and forgets the network
+// configuration, the caller must hold networkLk
+func resetNetwork() {
+	for _, c := range nodeControllers() {
+		if c != nil {
+			c.Shutdown()
+		}
+	}
+	controllersLk.Lock()
+	controllers = nil
+	controllersLk.Unlock()
+	configs = nil
+	disabledAtStart = nil
+	bootstrappingSet = false
+	nodeGroups = make(map[string][]int)
 }
 
 // global array of nodes, because im lazy and hate passing things to functions
@@ -195,38 +261,144 @@ var setuprpc bool
 var bootstrappingSet bool
 var logquiet bool
 var masterCtx context.Context
+var expectFailed bool
+
+// guards controllers and its entries, which the script and the http
+// handlers both touch. configs can be longer while a network is still
+// being configured.
+var controllersLk sync.RWMutex
+
+// controller returns the controller of node i, or nil if it hasnt been
+// started or doesnt exist yet
+func controller(i int) NodeController {
+	controllersLk.RLock()
+	defer controllersLk.RUnlock()
+	if i < 0 || i >= len(controllers) {
+		return nil
+	}
+	return controllers[i]
+}
+
+// nodeControllers returns a copy of the controllers to range over while
+// nodes start and stop
+func nodeControllers() []NodeController {
+	controllersLk.RLock()
+	defer controllersLk.RUnlock()
+	return append([]NodeController(nil), controllers...)
+}
+
+// numNodes returns how many nodes the network was built with
+func numNodes() int {
+	controllersLk.RLock()
+	defer controllersLk.RUnlock()
+	return len(controllers)
+}
 
 func main() {
 	cmdfile := flag.String("f", "", "a file of commands to run")
 	serv := flag.String("s", "", "address to run d3 viz server on")
 	rpc := flag.Bool("r", false, "whether or not to turn on rpc")
 	def := flag.Bool("default", false, "whether or not to load default config")
-	ins := flag.Bool("inspect", false, "whether or not to inspect stack afterwards")
 	quiet := flag.Bool("q", false, "supress obnoxious log messages")
+	flag.StringVar(&tracedir, "traces", tracedir, "directory to write lookup traces to")
+	flag.StringVar(&profiledir, "profiles", profiledir, "directory scripts write profiles and dumps to")
+	resout := flag.String("out", "", "file to record command results to (.json or .csv)")
+	series := flag.String("series", "", "file to write time series samples of the network to")
+	interval := flag.Duration("interval", time.Millisecond*500, "how often to sample the network for -series")
+	junit := flag.String("junit", "", "file to write a junit xml report of expectations to")
+	evfile := flag.String("events", "", "file to append an ndjson log of every event in the run to")
+	flag.Int64Var(&identitySeed, "seed", 0, "seed for node identities, for reproducible runs")
+	cpuprof := flag.String("cpuprofile", "", "write a cpu profile of the whole run to this file")
+	memprof := flag.String("memprofile", "", "write a heap profile to this file at the end of the run")
+	headless := flag.Bool("headless", false, "read no commands from stdin, drive the run through the -s api")
+	flag.StringVar(&controlToken, "token", "", "token that -s requires for /cmd and the api, a random one is made if not given")
+	ins := flag.Bool("inspect", false, "deprecated: write every goroutine stack to goroutines.txt when the run ends")
 	flag.Parse()
 	logquiet = *quiet
 
+	if flag.Arg(0) == "compare" {
+		os.Exit(RunCompare(flag.Args()[1:]))
+	}
+
+	var replay *Replay
+	if flag.Arg(0) == "replay" {
+		if flag.NArg() < 2 {
+			fmt.Println("usage: dhtHell [flags] replay run.ndjson")
+			os.Exit(ExitError)
+		}
+		rp, err := LoadReplay(flag.Arg(1))
+		if err != nil {
+			fmt.Printf("Error loading replay: %s\n", err)
+			os.Exit(ExitError)
+		}
+		replay = rp
+	}
+
 	setuprpc = *rpc
 
+	if *headless && *serv == "" {
+		fmt.Println("-headless needs -s to serve the api on")
+		os.Exit(ExitError)
+	}
+
 	u.Debug = true
 	runtime.GOMAXPROCS(10)
 
+	defer RecoverPanic()
+	HandleSignals()
+
 	if *serv != "" {
 		go RunServer(*serv)
 	}
 
+	if *junit != "" {
+		OnShutdown(func() {
+			if err := WriteJUnit(*junit); err != nil {
+				fmt.Printf("Error writing junit report: %s\n", err)
+			}
+		})
+	}
+
+	if *resout != "" {
+		if err := OpenResults(*resout); err != nil {
+			fmt.Println(err)
+			Shutdown(ExitError)
+		}
+		OnShutdown(CloseResults)
+	}
+
+	if *evfile != "" {
+		if err := OpenEventLog(*evfile); err != nil {
+			fmt.Println(err)
+			Shutdown(ExitError)
+		}
+		OnShutdown(CloseEventLog)
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	masterCtx = ctx
+	cancelMaster = cancel
+
+	// the api cant create a network while this one is being configured
+	networkLk.Lock()
+
 	// Setup Configuration and inputs
-	var scan *bufio.Scanner
+	var scan *ScriptScanner
 	testconf := new(testConfig)
-	if *cmdfile != "" {
+	if replay != nil {
+		replay.Configure()
+	} else if *cmdfile != "" {
 		fiscan, err := ParseCommandFile(*cmdfile, testconf)
 		if err != nil {
 			fmt.Println(err)
-			return
+			Shutdown(ExitError)
 		}
 		scan = fiscan
-	} else {
-		scan = bufio.NewScanner(os.Stdin)
+		if scan == nil && !*headless {
+			scan = NewScriptScanner("stdin", os.Stdin)
+		}
+	} else if !*headless {
+		scan = NewScriptScanner("stdin", os.Stdin)
 		if *def { // Default configuration
 			testconf.NumNodes = 15
 			SetupNConfigs(testconf)
@@ -234,59 +406,86 @@ func main() {
 				BootstrapTo(cfg, configs[0])
 			}
 		} else {
-			ConfigPrompt(scan)
+			if err := ConfigPrompt(scan); err != nil {
+				fmt.Println(err)
+				Shutdown(ExitError)
+			}
 			if scan.Err() != nil {
 				fmt.Printf("Scan error: %s\n", scan.Err())
 			}
 		}
 	}
 
-	ctx, cancel := context.WithCancel(context.TODO())
-	masterCtx = ctx
-
 	// Build ipfs nodes as specified by the global array of configurations
-	SetupNodes(ctx)
-
-	defer func() {
-		fi, err := os.Create("mem.prof")
+	if *headless && len(configs) == 0 {
+		networkLk.Unlock()
+		fmt.Println("Waiting for a network to be created through the api.")
+		<-networkReady
+	} else {
+		err := startNetwork(ctx)
+		networkLk.Unlock()
 		if err != nil {
-			panic(err)
+			fmt.Println(err)
+			Shutdown(ExitError)
 		}
-		pprof.WriteHeapProfile(fi)
-		fi.Close()
-	}()
-
-	fi, err := os.Create("cpu.prof")
-	if err != nil {
-		panic(err)
 	}
-	defer fi.Close()
-
-	pprof.StartCPUProfile(fi)
-	defer pprof.StopCPUProfile()
 
-	// Begin command execution
-	fmt.Println("Enter a command:")
-	for scan.Scan() {
-		if len(scan.Text()) == 0 {
-			continue
+	if *series != "" {
+		if err := RunSampler(ctx, *series, *interval); err != nil {
+			fmt.Println(err)
+			Shutdown(ExitError)
 		}
+	}
 
-		// ignore comments
-		if len(scan.Text()) > 0 && scan.Text()[0] == '#' {
-			continue
-		}
-		if scan.Text() == "==" {
-			// Switch over input to standard in
-			scan = bufio.NewScanner(os.Stdin)
-			continue
+	OnShutdown(StopProfiling)
+	if *cpuprof != "" {
+		if err := StartCPUProfile(*cpuprof); err != nil {
+			fmt.Println(err)
+			Shutdown(ExitError)
 		}
-		if !RunCommand(scan.Text()) {
-			return
+	}
+	if *ins {
+		fmt.Println("-inspect is deprecated, use 'goroutines name' in a script instead.")
+		OnShutdown(func() {
+			if err := WriteGoroutines("goroutines.txt"); err != nil {
+				fmt.Printf("Error writing goroutines: %s\n", err)
+			}
+		})
+	}
+	if *memprof != "" {
+		OnShutdown(func() {
+			if err := WriteHeapProfile(*memprof); err != nil {
+				fmt.Printf("Error writing heap profile: %s\n", err)
+			}
+		})
+	}
+
+	OnShutdown(func() {
+		PrintStats(os.Stdout, nil)
+	})
+
+	if replay != nil {
+		fmt.Printf("Replaying %d recorded operations.\n", len(replay.Ops))
+		if diffs := replay.Run(); diffs > 0 {
+			fmt.Printf("Replay differed from the recording in %d places.\n", diffs)
+			Shutdown(ExitFailed)
 		}
+		fmt.Println("Replay matched the recording.")
+		Shutdown(ExitOK)
+	}
+
+	// Begin command execution
+	ended := false
+	if scan != nil {
+		fmt.Println("Enter a command:")
+		ended = !RunScript(os.Stdout, scan, !*headless)
+	}
+	if *headless && !ended {
+		// the api or a signal ends the run from here
+		fmt.Println("Running headless.")
+		select {}
 	}
 
-	cancel()
 	fmt.Println("Cleaning up and printing bandwidth(I/O)")
 	/*
 		for _, c := range controllers {
@@ -300,8 +499,34 @@ func main() {
 		fmt.Println(string(gsjson))
 	*/
 
-	if *ins {
-		time.Sleep(time.Second * 2)
-		panic("lets take a look at things.")
+	Shutdown(ExitOK)
+}
+
+// RunScript runs every command read from scan, writing their output to
+// w and switching over to stdin at a '==' line if allowed to. It
+// returns false if a command ended the run.
+func RunScript(w io.Writer, scan *ScriptScanner, stdin bool) bool {
+	for scan.Scan() {
+		if len(scan.Text()) == 0 {
+			continue
+		}
+
+		// ignore comments
+		if len(scan.Text()) > 0 && scan.Text()[0] == '#' {
+			continue
+		}
+		if scan.Text() == "==" {
+			if !stdin {
+				return true
+			}
+			// Switch over input to standard in
+			scan = NewScriptScanner("stdin", os.Stdin)
+			continue
+		}
+		curPos = scan.Pos()
+		if !RunCommandTo(w, scan.Text()) {
+			return false
+		}
 	}
+	return true
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cmdMetrics are the running totals for a single command type
+type cmdMetrics struct {
+	Count    uint64
+	Failures uint64
+	Sum      time.Duration
+	Buckets  []uint64
+}
+
+// keyed by command name, protected by rslock
+var commandMetrics = make(map[string]*cmdMetrics)
+
+// observeResult adds the given result to the running command metrics,
+// the caller must hold rslock
+func observeResult(r *Result) {
+	cm, ok := commandMetrics[r.Command]
+	if !ok {
+		cm = &cmdMetrics{Buckets: make([]uint64, len(latencyBuckets)+1)}
+		commandMetrics[r.Command] = cm
+	}
+	cm.Count++
+	if !r.Success {
+		cm.Failures++
+	}
+	cm.Sum += r.Duration
+	cm.Buckets[bucketFor(r.Duration)]++
+}
+
+// bandwidth of nodes that have been killed or shut down, so network
+// wide totals never go down, protected by bwlk
+var bwlk sync.Mutex
+var retiredBW nodeBWInfo
+
+func (bw *nodeBWInfo) add(o nodeBWInfo) {
+	bw.BwIn += o.BwIn
+	bw.BwOut += o.BwOut
+	bw.MesRecv += o.MesRecv
+	bw.MesSend += o.MesSend
+}
+
+// retireNode stops a node with stop, keeping what it moved in the
+// network totals
+func retireNode(c NodeController, stop func()) {
+	bwlk.Lock()
+	defer bwlk.Unlock()
+	final := c.GetStatistics()
+	stop()
+	retiredBW.add(final)
+}
+
+// networkStatistics returns the bandwidth used by every node of the run
+// so far, including ones that are no longer running
+func networkStatistics() nodeBWInfo {
+	bwlk.Lock()
+	defer bwlk.Unlock()
+	total := retiredBW
+	for _, c := range nodeControllers() {
+		if c != nil && c.Alive() {
+			total.add(c.GetStatistics())
+		}
+	}
+	return total
+}
+
+// nodeState returns the lifecycle state of the given node, a node that
+// has no controller yet is off
+func nodeState(i int) string {
+	return controllerState(controller(i))
+}
+
+func controllerState(c NodeController) string {
+	switch {
+	case c == nil:
+		return "off"
+	case !c.Alive():
+		return "dead"
+	default:
+		return "running"
+	}
+}
+
+// ServeMetrics writes the harness metrics in the prometheus text format
+func ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteMetrics(w)
+}
+
+func WriteMetrics(w io.Writer) {
+	states := map[string]int{"off": 0, "dead": 0, "running": 0}
+	for _, c := range nodeControllers() {
+		states[controllerState(c)]++
+	}
+	bw := networkStatistics()
+
+	fmt.Fprintln(w, "# HELP dhthell_nodes Number of nodes by lifecycle state.")
+	fmt.Fprintln(w, "# TYPE dhthell_nodes gauge")
+	for _, st := range []string{"running", "dead", "off"} {
+		fmt.Fprintf(w, "dhthell_nodes{state=%q} %d\n", st, states[st])
+	}
+
+	fmt.Fprintln(w, "# HELP dhthell_bandwidth_bytes_total Bytes moved by every node of the run, including killed ones.")
+	fmt.Fprintln(w, "# TYPE dhthell_bandwidth_bytes_total counter")
+	fmt.Fprintf(w, "dhthell_bandwidth_bytes_total{direction=\"in\"} %d\n", bw.BwIn)
+	fmt.Fprintf(w, "dhthell_bandwidth_bytes_total{direction=\"out\"} %d\n", bw.BwOut)
+
+	writeCommandMetrics(w)
+	writeTransferMetrics(w)
+}
+
+func writeCommandMetrics(w io.Writer) {
+	rslock.Lock()
+	defer rslock.Unlock()
+
+	var cmds []string
+	for c := range commandMetrics {
+		cmds = append(cmds, c)
+	}
+	sort.Strings(cmds)
+
+	fmt.Fprintln(w, "# HELP dhthell_commands_total Commands run on nodes.")
+	fmt.Fprintln(w, "# TYPE dhthell_commands_total counter")
+	for _, c := range cmds {
+		fmt.Fprintf(w, "dhthell_commands_total{command=%q} %d\n", c, commandMetrics[c].Count)
+	}
+
+	fmt.Fprintln(w, "# HELP dhthell_command_failures_total Commands run on nodes that returned an error.")
+	fmt.Fprintln(w, "# TYPE dhthell_command_failures_total counter")
+	for _, c := range cmds {
+		fmt.Fprintf(w, "dhthell_command_failures_total{command=%q} %d\n", c, commandMetrics[c].Failures)
+	}
+
+	fmt.Fprintln(w, "# HELP dhthell_command_duration_seconds Latency of commands run on nodes.")
+	fmt.Fprintln(w, "# TYPE dhthell_command_duration_seconds histogram")
+	for _, c := range cmds {
+		cm := commandMetrics[c]
+		var cum uint64
+		for i, b := range latencyBuckets {
+			cum += cm.Buckets[i]
+			fmt.Fprintf(w, "dhthell_command_duration_seconds_bucket{command=%q,le=\"%g\"} %d\n", c, b.Seconds(), cum)
+		}
+		fmt.Fprintf(w, "dhthell_command_duration_seconds_bucket{command=%q,le=\"+Inf\"} %d\n", c, cm.Count)
+		fmt.Fprintf(w, "dhthell_command_duration_seconds_sum{command=%q} %g\n", c, cm.Sum.Seconds())
+		fmt.Fprintf(w, "dhthell_command_duration_seconds_count{command=%q} %d\n", c, cm.Count)
+	}
+}
+
+func writeTransferMetrics(w io.Writer) {
+	gslock.Lock()
+	defer gslock.Unlock()
+
+	var size uint64
+	var took time.Duration
+	for _, t := range globalStats.Transfers {
+		size += uint64(t.Size)
+		took += time.Duration(t.Time)
+	}
+
+	fmt.Fprintln(w, "# HELP dhthell_transfers_total Files read with readfile.")
+	fmt.Fprintln(w, "# TYPE dhthell_transfers_total counter")
+	fmt.Fprintf(w, "dhthell_transfers_total %d\n", len(globalStats.Transfers))
+
+	fmt.Fprintln(w, "# HELP dhthell_transfer_bytes_total Bytes read with readfile.")
+	fmt.Fprintln(w, "# TYPE dhthell_transfer_bytes_total counter")
+	fmt.Fprintf(w, "dhthell_transfer_bytes_total %d\n", size)
+
+	fmt.Fprintln(w, "# HELP dhthell_transfer_seconds_total Time spent reading files with readfile.")
+	fmt.Fprintln(w, "# TYPE dhthell_transfer_seconds_total counter")
+	fmt.Fprintf(w, "dhthell_transfer_seconds_total %g\n", took.Seconds())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+	"github.com/jbenet/go-ipfs/p2p/peer"
+	config "github.com/jbenet/go-ipfs/repo/config"
+	u "github.com/jbenet/go-ipfs/util"
+	ma "github.com/jbenet/go-multiaddr"
+)
+
+// fakeNode is a NodeController that only reports its state, bandwidth
+// and the provider records other peers answer with
+type fakeNode struct {
+	alive bool
+	bw    nodeBWInfo
+	provs map[peer.ID][]peer.ID
+}
+
+func (f *fakeNode) RunCommand(ctx context.Context, cmd []string) (string, error) {
+	return "", ErrUnknownCommand
+}
+func (f *fakeNode) Shutdown()                                   { f.alive = false }
+func (f *fakeNode) Alive() bool                                 { return f.alive }
+func (f *fakeNode) Peers() []peer.ID                            { return nil }
+func (f *fakeNode) NumPeers() int                               { return 0 }
+func (f *fakeNode) Addrs() []ma.Multiaddr                       { return nil }
+func (f *fakeNode) Blocks(ctx context.Context) ([]u.Key, error) { return nil, nil }
+func (f *fakeNode) GetStatistics() nodeBWInfo                   { return f.bw }
+func (f *fakeNode) HasValue(k u.Key) bool                       { return false }
+func (f *fakeNode) PeerID() peer.ID                             { return "" }
+func (f *fakeNode) AskProviders(ctx context.Context, p peer.ID, k u.Key) ([]peer.ID, error) {
+	return f.provs[p], nil
+}
+
+// scrape fetches /metrics from a local server, returning the value of
+// every sample by its name and labels
+func scrape(t *testing.T) map[string]float64 {
+	srv := httptest.NewServer(http.HandlerFunc(ServeMetrics))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("content type %q", ct)
+	}
+
+	samples := make(map[string]float64)
+	scan := bufio.NewScanner(resp.Body)
+	for scan.Scan() {
+		line := scan.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("bad sample %q: %s", line, err)
+		}
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+func TestMetricsScrape(t *testing.T) {
+	defer func(c []NodeController, r nodeBWInfo) { controllers, retiredBW = c, r }(controllers, retiredBW)
+	retiredBW = nodeBWInfo{}
+	controllers = []NodeController{
+		&fakeNode{alive: true, bw: nodeBWInfo{BwIn: 100, BwOut: 50}},
+		&fakeNode{alive: true, bw: nodeBWInfo{BwIn: 10, BwOut: 5}},
+		nil,
+	}
+
+	want := map[string]float64{
+		`dhthell_nodes{state="running"}`:                 2,
+		`dhthell_nodes{state="dead"}`:                    0,
+		`dhthell_nodes{state="off"}`:                     1,
+		`dhthell_bandwidth_bytes_total{direction="in"}`:  110,
+		`dhthell_bandwidth_bytes_total{direction="out"}`: 55,
+	}
+	check := func(got map[string]float64) {
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("%s = %g, want %g", k, got[k], v)
+			}
+		}
+	}
+	check(scrape(t))
+
+	// killing a node must not take its bytes out of the totals
+	retireNode(controllers[0], controllers[0].Shutdown)
+	want[`dhthell_nodes{state="running"}`] = 1
+	want[`dhthell_nodes{state="dead"}`] = 1
+	check(scrape(t))
+}
+
+func TestNodeStateWhileConfiguring(t *testing.T) {
+	defer func(c []*config.Config, n []NodeController) { configs, controllers = c, n }(configs, controllers)
+	configs = []*config.Config{new(config.Config), new(config.Config)}
+	controllers = []NodeController{&fakeNode{alive: true}}
+
+	if st := nodeState(1); st != "off" {
+		t.Fatalf("node without a controller is %q", st)
+	}
+	if nd := BuildNodeDetail(context.Background(), 1); nd.State != "off" {
+		t.Fatalf("node detail state %q", nd.State)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"code.google.com/p/go.net/context"
+	"github.com/jbenet/go-ipfs/p2p/peer"
+	u "github.com/jbenet/go-ipfs/util"
+)
+
+// how many of a nodes most recent commands the detail view shows
+const maxNodeOps = 50
+
+// how long to spend listing a nodes blocks
+const blockListTimeout = time.Second * 5
+
+// commands whose first argument is a dht key
+var keyedCommands = map[string]bool{
+	"put":      true,
+	"get":      true,
+	"store":    true,
+	"provide":  true,
+	"findprov": true,
+}
+
+// NodePeer is a peer a node knows about, and its index in the harness
+type NodePeer struct {
+	Peer string `json:"peer"`
+	Node *int   `json:"node,omitempty"`
+}
+
+// NodeRecord says whether a node holds the value of one key. The dht
+// keeps its routing table and provider records private, so those arent
+// part of the detail.
+type NodeRecord struct {
+	Key   string `json:"key"`
+	Value bool   `json:"value"`
+}
+
+// NodeDetail is everything the harness can say about a single node
+type NodeDetail struct {
+	Node  int      `json:"node"`
+	Peer  string   `json:"peer"`
+	State string   `json:"state"`
+	Addrs []string `json:"addrs"`
+	Group []string `json:"groups,omitempty"`
+
+	Connections []NodePeer `json:"connections"`
+
+	// the values held for every key the run has touched
+	Records []NodeRecord `json:"records"`
+	Blocks  []string     `json:"blocks"`
+
+	Ops []*Result `json:"ops"`
+}
+
+func nodePeers(ps []peer.ID) []NodePeer {
+	out := make([]NodePeer, 0, len(ps))
+	for _, p := range ps {
+		out = append(out, NodePeer{Peer: p.Pretty(), Node: nodeRef(NodeIndex(p))})
+	}
+	return out
+}
+
+// runKeys returns every dht key used by a command so far, the only
+// records we know to look for
+func runKeys() []string {
+	rslock.Lock()
+	defer rslock.Unlock()
+	seen := make(map[string]bool)
+	var keys []string
+	for _, r := range allResults {
+		if !keyedCommands[r.Command] || len(r.Args) == 0 || seen[r.Args[0]] {
+			continue
+		}
+		seen[r.Args[0]] = true
+		keys = append(keys, r.Args[0])
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// nodeOps returns the most recent results for the given node
+func nodeOps(i int) []*Result {
+	rslock.Lock()
+	defer rslock.Unlock()
+	var out []*Result
+	for j := len(allResults) - 1; j >= 0 && len(out) < maxNodeOps; j-- {
+		if allResults[j].Node == i {
+			out = append(out, allResults[j])
+		}
+	}
+	return out
+}
+
+// BuildNodeDetail gathers everything known about node i
+func BuildNodeDetail(ctx context.Context, i int) *NodeDetail {
+	c := controller(i)
+	nd := &NodeDetail{
+		Node:  i,
+		Peer:  configs[i].Identity.PeerID,
+		State: controllerState(c),
+		Ops:   nodeOps(i),
+	}
+	for name, idx := range nodeGroups {
+		if inGroup(i, idx) {
+			nd.Group = append(nd.Group, name)
+		}
+	}
+	sort.Strings(nd.Group)
+	if nd.State != "running" {
+		return nd
+	}
+
+	for _, a := range c.Addrs() {
+		nd.Addrs = append(nd.Addrs, a.String())
+	}
+	nd.Connections = nodePeers(c.Peers())
+
+	for _, k := range runKeys() {
+		nd.Records = append(nd.Records, NodeRecord{Key: k, Value: c.HasValue(u.Key(k))})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, blockListTimeout)
+	defer cancel()
+	blks, err := c.Blocks(ctx)
+	if err != nil {
+		fmt.Printf("Error listing blocks of node %d: %s\n", i, err)
+	}
+	for _, k := range blks {
+		nd.Blocks = append(nd.Blocks, k.B58String())
+	}
+	return nd
+}
+
+// ServeNode returns the detail of the node given by ?i= as json
+func ServeNode(w http.ResponseWriter, r *http.Request) {
+	i, err := strconv.Atoi(r.URL.Query().Get("i"))
+	if err != nil || i < 0 || i >= len(configs) {
+		http.Error(w, "i must be a node index", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(BuildNodeDetail(masterCtx, i)); err != nil {
+		fmt.Println(err)
+	}
+}
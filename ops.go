@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how many finished lookups to keep around for the visualization
+const maxRecentLookups = 100
+
+var lookupsLk sync.Mutex
+var lookupSeq int
+var recentLookups []*LookupTrace
+
+// rememberLookup keeps a finished lookup so it can be replayed in the
+// visualization, and announces it
+func rememberLookup(tr *LookupTrace) {
+	lookupsLk.Lock()
+	lookupSeq++
+	tr.lk.Lock()
+	tr.ID = lookupSeq
+	tr.lk.Unlock()
+	recentLookups = append(recentLookups, tr)
+	if len(recentLookups) > maxRecentLookups {
+		recentLookups = recentLookups[len(recentLookups)-maxRecentLookups:]
+	}
+	lookupsLk.Unlock()
+
+	Emit(&Event{
+		Type:     EvLookup,
+		Node:     tr.Node,
+		Op:       tr.ID,
+		Cmd:      fmt.Sprintf("%d %s %s", tr.Node, tr.Command, strings.Join(tr.Args, " ")),
+		Duration: tr.Duration,
+		Success:  tr.Error == "",
+		Error:    tr.Error,
+	})
+}
+
+func findLookup(id int) *LookupTrace {
+	lookupsLk.Lock()
+	defer lookupsLk.Unlock()
+	for _, tr := range recentLookups {
+		if tr.ID == id {
+			return tr
+		}
+	}
+	return nil
+}
+
+// lookupSummary is what the sidebar lists for each recent lookup
+type lookupSummary struct {
+	ID       int           `json:"id"`
+	Node     int           `json:"node"`
+	Command  string        `json:"command"`
+	Args     []string      `json:"args"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Queries  int           `json:"queries"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// ServeOps lists recent lookups, or with ?id=N returns the full trace of
+// one of them
+func ServeOps(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if ids := r.URL.Query().Get("id"); ids != "" {
+		id, err := strconv.Atoi(ids)
+		if err != nil {
+			http.Error(w, "bad lookup id", http.StatusBadRequest)
+			return
+		}
+		tr := findLookup(id)
+		if tr == nil {
+			http.Error(w, "no such lookup", http.StatusNotFound)
+			return
+		}
+		tr.lk.Lock()
+		b, err := json.Marshal(tr)
+		tr.lk.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+		return
+	}
+
+	lookupsLk.Lock()
+	out := make([]lookupSummary, 0, len(recentLookups))
+	for _, tr := range recentLookups {
+		tr.lk.Lock()
+		out = append(out, lookupSummary{
+			ID:       tr.ID,
+			Node:     tr.Node,
+			Command:  tr.Command,
+			Args:     tr.Args,
+			Start:    tr.Start,
+			Duration: tr.Duration,
+			Queries:  len(tr.Hops),
+			Error:    tr.Error,
+		})
+		tr.lk.Unlock()
+	}
+	lookupsLk.Unlock()
+
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		fmt.Println(err)
+	}
+}
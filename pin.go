@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"code.google.com/p/go.net/context"
+	"github.com/jbenet/go-ipfs/core"
+	mdag "github.com/jbenet/go-ipfs/merkledag"
+	u "github.com/jbenet/go-ipfs/util"
+)
+
+// resolveRef turns the name of a file or tree into its root key and the
+// keys of every block in its dag. Anything else is taken to be a base58
+// key, whose blocks arent known.
+func resolveRef(ref string) (u.Key, []u.Key, error) {
+	filesLk.RLock()
+	defer filesLk.RUnlock()
+	if f, ok := files[ref]; ok {
+		if f.RootKey == "" {
+			return "", nil, fmt.Errorf("file '%s' hasnt been added by anyone", ref)
+		}
+		return f.RootKey, f.keys, nil
+	}
+	if t, ok := trees[ref]; ok {
+		if t.RootKey == "" {
+			return "", nil, fmt.Errorf("tree '%s' hasnt been added by anyone", ref)
+		}
+		return t.RootKey, t.keys, nil
+	}
+	k := u.B58KeyDecode(ref)
+	if k == "" {
+		return "", nil, fmt.Errorf("'%s' is neither a file, a tree nor a key", ref)
+	}
+	return k, nil, nil
+}
+
+// refName names a key after the file or tree it is the root of
+func refName(k u.Key) string {
+	filesLk.RLock()
+	defer filesLk.RUnlock()
+	for name, f := range files {
+		if f.RootKey == k {
+			return name
+		}
+	}
+	for name, t := range trees {
+		if t.RootKey == k {
+			return name
+		}
+	}
+	return ""
+}
+
+// pinArgs parses 'ref [direct]', pins being recursive by default
+func pinArgs(cmdparts []string) (u.Key, bool, error) {
+	if len(cmdparts) < 3 {
+		return "", false, ErrArgCount
+	}
+	recursive := true
+	if len(cmdparts) > 3 {
+		if cmdparts[3] != "direct" {
+			return "", false, fmt.Errorf("unknown pin mode '%s'", cmdparts[3])
+		}
+		recursive = false
+	}
+	k, _, err := resolveRef(cmdparts[2])
+	return k, recursive, err
+}
+
+func PinRef(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
+	k, recursive, err := pinArgs(cmdparts)
+	if err == ErrArgCount {
+		return fmt.Sprintln("pin: '# pin ref [direct]'"), err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// a recursive pin fetches the whole dag if it isnt here already
+	nd, err := n.DAG.Get(k)
+	if err != nil {
+		return "", err
+	}
+	if err := n.Pinning.Pin(nd, recursive); err != nil {
+		return "", err
+	}
+	if err := n.Pinning.Flush(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Pinned %s\n", k.B58String()), nil
+}
+
+func UnpinRef(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
+	k, recursive, err := pinArgs(cmdparts)
+	if err == ErrArgCount {
+		return fmt.Sprintln("unpin: '# unpin ref [direct]'"), err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := n.Pinning.Unpin(k, recursive); err != nil {
+		return "", err
+	}
+	if err := n.Pinning.Flush(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Unpinned %s\n", k.B58String()), nil
+}
+
+// ListPins prints the recursive and direct pins of a node, and how
+// many blocks are pinned indirectly through them
+func ListPins(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
+	var buf bytes.Buffer
+	printKeys := func(kind string, keys []u.Key) {
+		var lines []string
+		for _, k := range keys {
+			line := k.B58String()
+			if name := refName(k); name != "" {
+				line += " (" + name + ")"
+			}
+			lines = append(lines, line)
+		}
+		sort.Strings(lines)
+		fmt.Fprintf(&buf, "%s: %d\n", kind, len(lines))
+		for _, l := range lines {
+			fmt.Fprintf(&buf, "\t%s\n", l)
+		}
+	}
+	printKeys("recursive", n.Pinning.RecursiveKeys())
+	printKeys("direct", n.Pinning.DirectKeys())
+	fmt.Fprintf(&buf, "indirect: %d\n", len(n.Pinning.IndirectKeys()))
+	return buf.String(), nil
+}
+
+// GarbageCollect removes every block the node has not pinned
+func GarbageCollect(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
+	keys, err := n.Blockstore.AllKeysChan(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// gather the keys first, so the blockstore isnt changed under the
+	// listing
+	var unpinned []u.Key
+	total := 0
+	for k := range keys {
+		total++
+		if !n.Pinning.IsPinned(k) {
+			unpinned = append(unpinned, k)
+		}
+	}
+
+	for _, k := range unpinned {
+		if err := n.Blockstore.DeleteBlock(k); err != nil {
+			return "", fmt.Errorf("removing %s: %s", k.B58String(), err)
+		}
+	}
+	return fmt.Sprintf("Removed %d of %d blocks\n", len(unpinned), total), nil
+}
+
+// heldBlocks counts how many blocks of the dag ref names are held
+// locally, out of how many. Files and trees are checked against every
+// block recorded when they were added. Bare keys are walked through the
+// blocks held, so a missing block hides whatever is below it.
+func heldBlocks(n *core.IpfsNode, ref string) (held, total int, err error) {
+	root, keys, err := resolveRef(ref)
+	if err != nil {
+		return 0, 0, err
+	}
+	if keys != nil {
+		for _, k := range keys {
+			has, err := n.Blockstore.Has(k)
+			if err != nil {
+				return 0, 0, err
+			}
+			if has {
+				held++
+			}
+		}
+		return held, len(keys), nil
+	}
+
+	seen := map[u.Key]bool{root: true}
+	todo := []u.Key{root}
+	for len(todo) > 0 {
+		k := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		total++
+		has, err := n.Blockstore.Has(k)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !has {
+			continue
+		}
+		held++
+
+		b, err := n.Blockstore.Get(k)
+		if err != nil {
+			return 0, 0, err
+		}
+		nd, err := mdag.Decoded(b.Data)
+		if err != nil {
+			// not a dag node, so nothing below it
+			continue
+		}
+		for _, l := range nd.Links {
+			lk := u.Key(l.Hash)
+			if !seen[lk] {
+				seen[lk] = true
+				todo = append(todo, lk)
+			}
+		}
+	}
+	return held, total, nil
+}
+
+// HasBlock succeeds if every block of the dag ref names is held locally
+func HasBlock(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
+	if len(cmdparts) < 3 {
+		return fmt.Sprintln("has: '# has ref'"), ErrArgCount
+	}
+	held, total, err := heldBlocks(n, cmdparts[2])
+	if err != nil {
+		return "", err
+	}
+	if held < total {
+		return "", fmt.Errorf("%s: only %d of %d blocks are held locally", cmdparts[2], held, total)
+	}
+	return fmt.Sprintf("%s: all %d blocks are held locally\n", cmdparts[2], total), nil
+}
+
+// LacksBlock succeeds if no block of the dag ref names is held locally
+func LacksBlock(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
+	if len(cmdparts) < 3 {
+		return fmt.Sprintln("lacks: '# lacks ref'"), ErrArgCount
+	}
+	held, total, err := heldBlocks(n, cmdparts[2])
+	if err != nil {
+		return "", err
+	}
+	if held > 0 {
+		return "", fmt.Errorf("%s: %d of %d blocks are still held locally", cmdparts[2], held, total)
+	}
+	return fmt.Sprintf("%s: none of %d blocks are held locally\n", cmdparts[2], total), nil
+}
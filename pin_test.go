@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"code.google.com/p/go.net/context"
+	ds "github.com/jbenet/go-datastore"
+	dssync "github.com/jbenet/go-datastore/sync"
+	"github.com/jbenet/go-ipfs/blocks/blockstore"
+	bserv "github.com/jbenet/go-ipfs/blockservice"
+	"github.com/jbenet/go-ipfs/core"
+	offline "github.com/jbenet/go-ipfs/exchange/offline"
+	mdag "github.com/jbenet/go-ipfs/merkledag"
+	"github.com/jbenet/go-ipfs/pin"
+)
+
+// offlineNode is a node with just the blocks, dag and pins the pinning
+// commands use, all held in memory
+func offlineNode(t *testing.T) *core.IpfsNode {
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	bs := blockstore.NewBlockstore(dstore)
+	bsrv, err := bserv.New(bs, offline.Exchange(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dag := mdag.NewDAGService(bsrv)
+	return &core.IpfsNode{
+		Blockstore: bs,
+		DAG:        dag,
+		Pinning:    pin.NewPinner(dstore, dag),
+	}
+}
+
+func TestUnpinnedTreeIsCollected(t *testing.T) {
+	ti, err := MakeTree("pintree", []string{"depth=1", "fanout=2", "filesize=600KB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTree(ti)
+	defer delete(trees, "pintree")
+
+	n := offlineNode(t)
+	ctx := context.Background()
+	for _, step := range []struct {
+		f   CmdFunc
+		cmd []string
+	}{
+		{AddTree, []string{"0", "addtree", "pintree"}},
+		{HasBlock, []string{"0", "has", "pintree"}},
+		{GarbageCollect, []string{"0", "gc"}},
+		{HasBlock, []string{"0", "has", "pintree"}},
+		{UnpinRef, []string{"0", "unpin", "pintree"}},
+		{GarbageCollect, []string{"0", "gc"}},
+		{LacksBlock, []string{"0", "lacks", "pintree"}},
+	} {
+		if out, err := step.f(ctx, n, step.cmd); err != nil {
+			t.Fatalf("%v: %s %s", step.cmd, out, err)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strings"
+	"sync"
+)
+
+var proflk sync.Mutex
+var cpuProfile *os.File
+var execTrace *os.File
+
+// directory profiles and dumps asked for by scripts are written to.
+// Commands can come from the control panel, so they only name files
+// inside it.
+var profiledir = "profiles"
+
+// profilePath places a profile named by a script in profiledir, adding
+// the given extension to names that dont have one
+func profilePath(name, ext string) (string, error) {
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("profile name '%s' must stay inside %s", name, profiledir)
+	}
+	if filepath.Ext(clean) == "" {
+		clean += ext
+	}
+	path := filepath.Join(profiledir, clean)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// StartCPUProfile starts writing a cpu profile to the given file
+func StartCPUProfile(path string) error {
+	proflk.Lock()
+	defer proflk.Unlock()
+	if cpuProfile != nil {
+		return fmt.Errorf("cpu profile already running to %s", cpuProfile.Name())
+	}
+
+	fi, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := pprof.StartCPUProfile(fi); err != nil {
+		fi.Close()
+		return err
+	}
+	cpuProfile = fi
+	return nil
+}
+
+// StopCPUProfile stops the running cpu profile
+func StopCPUProfile() error {
+	proflk.Lock()
+	defer proflk.Unlock()
+	if cpuProfile == nil {
+		return errors.New("no cpu profile running")
+	}
+	pprof.StopCPUProfile()
+	err := cpuProfile.Close()
+	cpuProfile = nil
+	return err
+}
+
+// StartExecTrace starts writing a go execution trace to the given file
+func StartExecTrace(path string) error {
+	proflk.Lock()
+	defer proflk.Unlock()
+	if execTrace != nil {
+		return fmt.Errorf("execution trace already running to %s", execTrace.Name())
+	}
+
+	fi, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := trace.Start(fi); err != nil {
+		fi.Close()
+		return err
+	}
+	execTrace = fi
+	return nil
+}
+
+// StopExecTrace stops the running execution trace
+func StopExecTrace() error {
+	proflk.Lock()
+	defer proflk.Unlock()
+	if execTrace == nil {
+		return errors.New("no execution trace running")
+	}
+	trace.Stop()
+	err := execTrace.Close()
+	execTrace = nil
+	return err
+}
+
+// WriteHeapProfile writes a heap profile, after a gc so it reflects
+// what is actually live
+func WriteHeapProfile(path string) error {
+	fi, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	runtime.GC()
+	return pprof.WriteHeapProfile(fi)
+}
+
+// WriteGoroutines writes the stack of every goroutine
+func WriteGoroutines(path string) error {
+	fi, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	return pprof.Lookup("goroutine").WriteTo(fi, 2)
+}
+
+// StopProfiling stops anything still running when the run ends
+func StopProfiling() {
+	proflk.Lock()
+	cpu, tr := cpuProfile != nil, execTrace != nil
+	proflk.Unlock()
+
+	if cpu {
+		if err := StopCPUProfile(); err != nil {
+			fmt.Printf("Error stopping cpu profile: %s\n", err)
+		}
+	}
+	if tr {
+		if err := StopExecTrace(); err != nil {
+			fmt.Printf("Error stopping execution trace: %s\n", err)
+		}
+	}
+}
+
+// ProfileCommand runs one of the profiling script commands:
+//
+//	profile start cpu name
+//	profile stop
+//	heapdump name
+//	goroutines name
+//	trace start name
+//	trace stop
+func ProfileCommand(cmdparts []string) error {
+	switch {
+	case cmdparts[0] == "profile" && len(cmdparts) >= 4 && cmdparts[1] == "start":
+		if cmdparts[2] != "cpu" {
+			return fmt.Errorf("unknown profile type '%s'", cmdparts[2])
+		}
+		path, err := profilePath(cmdparts[3], ".prof")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Writing cpu profile to %s\n", path)
+		return StartCPUProfile(path)
+	case cmdparts[0] == "profile" && len(cmdparts) == 2 && cmdparts[1] == "stop":
+		return StopCPUProfile()
+	case cmdparts[0] == "heapdump" && len(cmdparts) == 2:
+		path, err := profilePath(cmdparts[1], ".prof")
+		if err != nil {
+			return err
+		}
+		return WriteHeapProfile(path)
+	case cmdparts[0] == "goroutines" && len(cmdparts) == 2:
+		path, err := profilePath(cmdparts[1], ".txt")
+		if err != nil {
+			return err
+		}
+		return WriteGoroutines(path)
+	case cmdparts[0] == "trace" && len(cmdparts) == 3 && cmdparts[1] == "start":
+		path, err := profilePath(cmdparts[2], ".trace")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Writing execution trace to %s\n", path)
+		return StartExecTrace(path)
+	case cmdparts[0] == "trace" && len(cmdparts) == 2 && cmdparts[1] == "stop":
+		return StopExecTrace()
+	}
+	return fmt.Errorf("usage: 'profile start cpu name', 'profile stop', 'heapdump name', " +
+		"'goroutines name', 'trace start name' or 'trace stop'")
+}
+
+// isProfileCommand tells profiling commands apart from traced lookups,
+// which also start with 'trace'
+func isProfileCommand(cmdparts []string) bool {
+	switch cmdparts[0] {
+	case "profile", "heapdump", "goroutines":
+		return true
+	case "trace":
+		return len(cmdparts) > 1 && (cmdparts[1] == "start" || cmdparts[1] == "stop")
+	}
+	return false
+}
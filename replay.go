@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commands whose output should match exactly between a run and its
+// replay, everything else prints timings or peer lists
+var stableOutput = map[string]bool{
+	"get":   true,
+	"put":   true,
+	"store": true,
+	"add":   true,
+}
+
+// replayOp is a single thing to re-issue during a replay
+type replayOp struct {
+	// offset from the start of the recorded run it was issued at,
+	// and when it finished
+	At   time.Duration
+	Done time.Duration
+
+	Cmd  string
+	Node int // -1 for commands that arent run on a node
+
+	// the recorded outcome
+	Success bool
+	Error   string
+	Output  string
+
+	finished chan struct{}
+}
+
+// Replay is a recorded run loaded back from its event log
+type Replay struct {
+	Setup *RunSetup
+	Ops   []*replayOp
+}
+
+// LoadReplay reads the event log of a previous run
+func LoadReplay(path string) (*Replay, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	rp := new(Replay)
+	var start time.Duration
+	// issued commands waiting for their completion, by node and line
+	pending := make(map[string][]*replayOp)
+
+	scan := bufio.NewScanner(fi)
+	scan.Buffer(nil, 16*1024*1024)
+	for scan.Scan() {
+		ev := new(Event)
+		if err := json.Unmarshal(scan.Bytes(), ev); err != nil {
+			return nil, err
+		}
+
+		if ev.Type == EvRunStart {
+			if rp.Setup != nil {
+				return nil, errors.New("event log holds more than one run")
+			}
+			rp.Setup = ev.Setup
+			start = ev.T
+			continue
+		}
+		if rp.Setup == nil {
+			// events from building the initial nodes
+			continue
+		}
+
+		at := ev.T - start
+		switch ev.Type {
+		case EvCmdIssued:
+			op := &replayOp{At: at, Cmd: ev.Cmd, Node: ev.Node}
+			pending[ev.Cmd] = append(pending[ev.Cmd], op)
+			rp.Ops = append(rp.Ops, op)
+		case EvCmdDone:
+			ops := pending[ev.Cmd]
+			if len(ops) == 0 {
+				return nil, fmt.Errorf("completion of '%s' that was never issued", ev.Cmd)
+			}
+			op := ops[0]
+			pending[ev.Cmd] = ops[1:]
+			op.Done = at
+			op.Success = ev.Success
+			op.Error = ev.Error
+			op.Output = ev.Output
+		case EvFileCreate:
+			rp.Ops = append(rp.Ops, &replayOp{At: at, Done: at, Cmd: ev.Cmd, Node: -1, Success: true})
+		case EvNodeStart, EvNodeRestart:
+			cmd := fmt.Sprintf("%d start", ev.Node)
+			rp.Ops = append(rp.Ops, &replayOp{At: at, Done: at, Cmd: cmd, Node: -1, Success: true})
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	if rp.Setup == nil {
+		return nil, errors.New("no run_start event in log, was the run set up?")
+	}
+
+	// commands that never finished (the run was interrupted) still get
+	// replayed, but nothing waits on them
+	for _, ops := range pending {
+		for _, op := range ops {
+			op.Done = -1
+		}
+	}
+	sort.Sort(opsByTime(rp.Ops))
+	return rp, nil
+}
+
+type opsByTime []*replayOp
+
+func (o opsByTime) Len() int           { return len(o) }
+func (o opsByTime) Less(i, j int) bool { return o[i].At < o[j].At }
+func (o opsByTime) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+
+// Configure sets up the node configs the way the recorded run had them
+func (rp *Replay) Configure() {
+	if rp.Setup.Seed == 0 {
+		fmt.Println("WARNING: recorded run had no -seed, node identities will differ.")
+	}
+	if identitySeed == 0 {
+		identitySeed = rp.Setup.Seed
+	}
+
+	SetupNConfigs(&testConfig{NumNodes: rp.Setup.Nodes})
+	for i, bs := range rp.Setup.Bootstrap {
+		for _, j := range bs {
+			BootstrapTo(configs[i], configs[j])
+		}
+	}
+	for _, i := range rp.Setup.Off {
+		disabledAtStart[i] = true
+	}
+	for g, nodes := range rp.Setup.Groups {
+		nodeGroups[g] = nodes
+	}
+}
+
+// Run re-issues every recorded command at the same time relative to the
+// start of the run, keeping the order of commands that finished before
+// others were issued, and returns the number of differing results
+func (rp *Replay) Run() int {
+	for _, op := range rp.Ops {
+		op.finished = make(chan struct{})
+	}
+
+	var lk sync.Mutex
+	diffs := 0
+	var wg sync.WaitGroup
+	begin := time.Now()
+	for k, op := range rp.Ops {
+		// anything the original run had finished by now has to
+		// finish here too before we go on
+		for _, prev := range rp.Ops[:k] {
+			if prev.Done >= 0 && prev.Done <= op.At {
+				<-prev.finished
+			}
+		}
+		if wait := op.At - time.Since(begin); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		if op.Node < 0 {
+			RunCommand(op.Cmd)
+			close(op.finished)
+			continue
+		}
+
+		wg.Add(1)
+		go func(op *replayOp) {
+			defer wg.Done()
+			defer close(op.finished)
+			defer RecoverPanic()
+
+			diff := op.replay()
+			if diff != "" {
+				lk.Lock()
+				diffs++
+				fmt.Printf("DIFF at %s: %s\n", op.At, diff)
+				lk.Unlock()
+			}
+		}(op)
+	}
+	wg.Wait()
+	return diffs
+}
+
+// replay runs the op on its node and describes how the result differs
+// from the recorded one, if it does
+func (op *replayOp) replay() string {
+	cmdparts := strings.Split(op.Cmd, " ")
+	if len(cmdparts) < 2 {
+		return fmt.Sprintf("'%s': malformed command", op.Cmd)
+	}
+	idex, err := strconv.Atoi(cmdparts[0])
+	if err != nil || idex < 0 || idex >= numNodes() {
+		return fmt.Sprintf("'%s': bad node index", op.Cmd)
+	}
+
+	out, err := runOnNode(idex, cmdparts, false)
+	if !logquiet {
+		fmt.Print(out)
+	}
+
+	if op.Done < 0 {
+		// we never saw how this ended the first time
+		return ""
+	}
+	switch {
+	case op.Success && err != nil:
+		return fmt.Sprintf("'%s' succeeded in recording, failed in replay: %s", op.Cmd, err)
+	case !op.Success && err == nil:
+		return fmt.Sprintf("'%s' failed in recording (%s), succeeded in replay", op.Cmd, op.Error)
+	case op.Success && stableOutput[strings.ToLower(cmdparts[1])] && out != op.Output:
+		return fmt.Sprintf("'%s' output differs: recorded %q, replayed %q", op.Cmd, op.Output, out)
+	}
+	return ""
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/jbenet/go-ipfs/routing"
+	u "github.com/jbenet/go-ipfs/util"
+)
+
+var ErrDeadNode = errors.New("Attempted to run command on dead node!")
+
+// Result is the outcome of a single command run on a single node
+type Result struct {
+	Time     time.Time     `json:"time"`
+	Node     int           `json:"node"`
+	PeerID   string        `json:"peer_id"`
+	Command  string        `json:"command"`
+	Args     []string      `json:"args"`
+	Duration time.Duration `json:"duration"`
+	Success  bool          `json:"success"`
+	ErrClass string        `json:"error_class,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Output   string        `json:"output"`
+
+	// file bytes moved by the command, and the bandwidth used by
+	// the node while it ran. Bandwidth comes from the node's own
+	// counters, so it includes anything else the node did meanwhile,
+	// such as other commands run with 'go'.
+	Bytes int64  `json:"bytes,omitempty"`
+	BwIn  uint64 `json:"bw_in,omitempty"`
+	BwOut uint64 `json:"bw_out,omitempty"`
+}
+
+// ResultWriter writes results out in some machine readable format
+type ResultWriter interface {
+	WriteResult(*Result) error
+	Close() error
+}
+
+var rslock sync.Mutex
+var resultsOut ResultWriter
+
+// OpenResults starts recording every command result to the given file,
+// as csv if it ends in '.csv' and as a json array otherwise
+func OpenResults(path string) error {
+	fi, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	rslock.Lock()
+	defer rslock.Unlock()
+	if strings.ToLower(filepath.Ext(path)) == ".csv" {
+		resultsOut, err = newCsvResults(fi)
+	} else {
+		resultsOut, err = newJsonResults(fi)
+	}
+	return err
+}
+
+// CloseResults flushes and closes the results file, if there is one
+func CloseResults() {
+	rslock.Lock()
+	defer rslock.Unlock()
+	if resultsOut == nil {
+		return
+	}
+	if err := resultsOut.Close(); err != nil {
+		fmt.Printf("Error closing results file: %s\n", err)
+	}
+	resultsOut = nil
+}
+
+// NewResult builds a result for the given command
+func NewResult(idex int, cmdparts []string, start time.Time, out string, err error) *Result {
+	r := &Result{
+		Time:     start,
+		Node:     idex,
+		Command:  strings.ToLower(cmdparts[1]),
+		Args:     cmdparts[2:],
+		Duration: time.Since(start),
+		Success:  err == nil,
+		ErrClass: ErrorClass(err),
+		Output:   out,
+	}
+	if idex >= 0 && idex < len(configs) {
+		r.PeerID = configs[idex].Identity.PeerID
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// longest command output kept for the whole run, the results file
+// gets all of it
+const maxKeptOutput = 256
+
+// RecordResult adds the result to the run statistics and writes it to
+// the results file
+func RecordResult(r *Result) {
+	rslock.Lock()
+	defer rslock.Unlock()
+	kept := *r
+	if len(kept.Output) > maxKeptOutput {
+		// copied, so the rest of the output can be freed
+		kept.Output = string([]byte(kept.Output[:maxKeptOutput])) + "..."
+	}
+	allResults = append(allResults, &kept)
+	observeResult(r)
+	if resultsOut != nil {
+		if err := resultsOut.WriteResult(r); err != nil {
+			fmt.Printf("Error writing result: %s\n", err)
+		}
+	}
+}
+
+// ErrorClass buckets an error into a short class name so failures
+// can be grouped without parsing messages
+func ErrorClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case err == ErrArgCount:
+		return "argcount"
+	case err == ErrDeadNode:
+		return "deadnode"
+	case err == ErrUnknownCommand:
+		return "unknown"
+	case err == context.DeadlineExceeded:
+		return "timeout"
+	case err == u.ErrNotFound || err == routing.ErrNotFound:
+		return "notfound"
+	default:
+		return "error"
+	}
+}
+
+type jsonResults struct {
+	w     io.WriteCloser
+	first bool
+}
+
+func newJsonResults(w io.WriteCloser) (*jsonResults, error) {
+	if _, err := w.Write([]byte("[\n")); err != nil {
+		return nil, err
+	}
+	return &jsonResults{w: w, first: true}, nil
+}
+
+func (jr *jsonResults) WriteResult(r *Result) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if !jr.first {
+		if _, err := jr.w.Write([]byte(",\n")); err != nil {
+			return err
+		}
+	}
+	jr.first = false
+	_, err = jr.w.Write(b)
+	return err
+}
+
+func (jr *jsonResults) Close() error {
+	if _, err := jr.w.Write([]byte("\n]\n")); err != nil {
+		jr.w.Close()
+		return err
+	}
+	return jr.w.Close()
+}
+
+var csvHeader = []string{"time", "node", "peer_id", "command", "args",
+	"duration", "success", "error_class", "error", "output",
+	"bytes", "bw_in", "bw_out"}
+
+// results files from before bytes and bandwidth were recorded have only
+// the first columns
+const oldCsvColumns = 10
+
+type csvResults struct {
+	w  io.Closer
+	cw *csv.Writer
+}
+
+func newCsvResults(w io.WriteCloser) (*csvResults, error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return nil, err
+	}
+	return &csvResults{w: w, cw: cw}, nil
+}
+
+func (cr *csvResults) WriteResult(r *Result) error {
+	return cr.cw.Write([]string{
+		r.Time.Format(time.RFC3339Nano),
+		strconv.Itoa(r.Node),
+		r.PeerID,
+		r.Command,
+		strings.Join(r.Args, " "),
+		strconv.FormatInt(int64(r.Duration), 10),
+		strconv.FormatBool(r.Success),
+		r.ErrClass,
+		r.Error,
+		r.Output,
+		strconv.FormatInt(r.Bytes, 10),
+		strconv.FormatUint(r.BwIn, 10),
+		strconv.FormatUint(r.BwOut, 10),
+	})
+}
+
+func (cr *csvResults) Close() error {
+	cr.cw.Flush()
+	if err := cr.cw.Error(); err != nil {
+		cr.w.Close()
+		return err
+	}
+	return cr.w.Close()
+}
+
+// LoadResults reads back a results file written with -out
+func LoadResults(path string) ([]*Result, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	if strings.ToLower(filepath.Ext(path)) != ".csv" {
+		var rs []*Result
+		if err := json.NewDecoder(fi).Decode(&rs); err != nil {
+			return nil, err
+		}
+		return rs, nil
+	}
+
+	records, err := csv.NewReader(fi).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || !validCsvHeader(records[0]) {
+		return nil, errors.New("results csv has wrong header")
+	}
+
+	var rs []*Result
+	for _, rec := range records[1:] {
+		r, err := parseCsvResult(rec, len(records[0]))
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// validCsvHeader accepts the current header and the old one without
+// bytes and bandwidth
+func validCsvHeader(h []string) bool {
+	if len(h) != len(csvHeader) && len(h) != oldCsvColumns {
+		return false
+	}
+	for i := range h {
+		if h[i] != csvHeader[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCsvResult reads a row of a results file with ncols columns,
+// leaving the fields an old file lacks at zero
+func parseCsvResult(rec []string, ncols int) (*Result, error) {
+	if len(rec) != ncols {
+		return nil, fmt.Errorf("results csv row has %d fields, expected %d", len(rec), ncols)
+	}
+	r := &Result{
+		PeerID:   rec[2],
+		Command:  rec[3],
+		ErrClass: rec[7],
+		Error:    rec[8],
+		Output:   rec[9],
+	}
+	if rec[4] != "" {
+		r.Args = strings.Split(rec[4], " ")
+	}
+
+	var err error
+	if r.Time, err = time.Parse(time.RFC3339Nano, rec[0]); err != nil {
+		return nil, err
+	}
+	if r.Node, err = strconv.Atoi(rec[1]); err != nil {
+		return nil, err
+	}
+	dur, err := strconv.ParseInt(rec[5], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	r.Duration = time.Duration(dur)
+	if r.Success, err = strconv.ParseBool(rec[6]); err != nil {
+		return nil, err
+	}
+	if ncols == oldCsvColumns {
+		return r, nil
+	}
+	if r.Bytes, err = strconv.ParseInt(rec[10], 10, 64); err != nil {
+		return nil, err
+	}
+	if r.BwIn, err = strconv.ParseUint(rec[11], 10, 64); err != nil {
+		return nil, err
+	}
+	if r.BwOut, err = strconv.ParseUint(rec[12], 10, 64); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadResultsCsv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dhthell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	when := time.Now().Format(time.RFC3339Nano)
+	old := strings.Join(csvHeader[:oldCsvColumns], ",") + "\n" +
+		when + ",3,Qm,get,k,1000,true,,,out\n"
+	cur := strings.Join(csvHeader, ",") + "\n" +
+		when + ",3,Qm,readfile,f,1000,true,,,out,4096,10,20\n"
+
+	tests := []struct {
+		name, csv string
+		ok        bool
+		bytes     int64
+		bw        uint64
+	}{
+		{"current", cur, true, 4096, 30},
+		{"old", old, true, 0, 0},
+		{"unknown header", "a,b,c\n", false, 0, 0},
+		{"short row", strings.Join(csvHeader, ",") + "\n" + when + ",3\n", false, 0, 0},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "r.csv")
+		if err := ioutil.WriteFile(path, []byte(tt.csv), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rs, err := LoadResults(path)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(rs) != 1 || rs[0].Node != 3 || rs[0].Duration != 1000 {
+			t.Errorf("%s: read %+v", tt.name, rs)
+			continue
+		}
+		if rs[0].Bytes != tt.bytes || rs[0].BwIn+rs[0].BwOut != tt.bw {
+			t.Errorf("%s: bytes %d, bandwidth %d, want %d, %d", tt.name, rs[0].Bytes, rs[0].BwIn+rs[0].BwOut, tt.bytes, tt.bw)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// ScriptScanner reads commands line by line while keeping track of
+// where they came from, so failures can point back at the script
+type ScriptScanner struct {
+	*bufio.Scanner
+	Name string
+	Line int
+}
+
+func NewScriptScanner(name string, r io.Reader) *ScriptScanner {
+	return &ScriptScanner{
+		Scanner: bufio.NewScanner(r),
+		Name:    name,
+	}
+}
+
+func (s *ScriptScanner) Scan() bool {
+	if !s.Scanner.Scan() {
+		return false
+	}
+	s.Line++
+	return true
+}
+
+// Pos returns the position of the most recently scanned line
+func (s *ScriptScanner) Pos() ScriptPos {
+	return ScriptPos{File: s.Name, Line: s.Line}
+}
+
+// ScriptPos is the location of a command in a script
+type ScriptPos struct {
+	File string
+	Line int
+}
+
+func (p ScriptPos) String() string {
+	return fmt.Sprintf("%s:%d", p.File, p.Line)
+}
+
+// position of the command currently being run from the main loop
+var curPos = ScriptPos{File: "stdin"}
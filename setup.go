@@ -1,8 +1,12 @@
 package main
 
 import (
+	"crypto/rsa"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
+	"math/big"
 	"strconv"
 	"strings"
 
@@ -18,13 +22,22 @@ import (
 	b58 "github.com/jbenet/go-base58"
 )
 
-// GenIdentity creates a random keypair and returns the associated
-// peerID and private key encoded to match config values
-func GenIdentity() (string, string, error) {
-	k, pub, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 512, u.NewTimeSeededRand())
+// seed for node identities, zero means a new random set every run
+var identitySeed int64
+
+// GenIdentity creates a keypair from r and returns the associated
+// peerID and private key encoded to match config values. The same r
+// always gives the same identity.
+func GenIdentity(r io.Reader) (string, string, error) {
+	sk, err := seededRSAKey(r, 512)
+	if err != nil {
+		return "", "", err
+	}
+	k, err := crypto.UnmarshalRsaPrivateKey(x509.MarshalPKCS1PrivateKey(sk))
 	if err != nil {
 		return "", "", err
 	}
+	pub := k.GetPublic()
 
 	b, err := k.Bytes()
 	if err != nil {
@@ -42,19 +55,84 @@ func GenIdentity() (string, string, error) {
 	return id, privkey, nil
 }
 
+// seededRSAKey builds an rsa key from nothing but what it reads from r.
+// rsa.GenerateKey and rand.Prime cant be used for this, as they mix in
+// randomness of their own.
+func seededRSAKey(r io.Reader, bits int) (*rsa.PrivateKey, error) {
+	e := big.NewInt(65537)
+	one := big.NewInt(1)
+	for {
+		p, err := seededPrime(r, bits-bits/2)
+		if err != nil {
+			return nil, err
+		}
+		q, err := seededPrime(r, bits/2)
+		if err != nil {
+			return nil, err
+		}
+		if p.Cmp(q) == 0 {
+			continue
+		}
+		n := new(big.Int).Mul(p, q)
+		if n.BitLen() != bits {
+			continue
+		}
+		totient := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+		d := new(big.Int).ModInverse(e, totient)
+		if d == nil {
+			continue
+		}
+
+		sk := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		sk.Precompute()
+		return sk, nil
+	}
+}
+
+// seededPrime reads candidates of the given size from r until one is
+// prime. ProbablyPrime is deterministic, so the same r gives the same
+// prime.
+func seededPrime(r io.Reader, bits int) (*big.Int, error) {
+	buf := make([]byte, (bits+7)/8)
+	top := uint(bits % 8)
+	if top == 0 {
+		top = 8
+	}
+	p := new(big.Int)
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		// exactly bits long with the top two bits set, so the product
+		// of two is never a bit short, and odd
+		buf[0] &= uint8(int(1<<top) - 1)
+		if top >= 2 {
+			buf[0] |= 3 << (top - 2)
+		} else {
+			buf[0] |= 1
+			buf[1] |= 0x80
+		}
+		buf[len(buf)-1] |= 1
+
+		p.SetBytes(buf)
+		if p.ProbablyPrime(20) {
+			return p, nil
+		}
+	}
+}
+
 // Creates an ipfs node that listens on the given multiaddr and bootstraps to
 // the peer in 'bootstrap'
-func nodeFromConfig(ctx context.Context, cfg *config.Config) *core.IpfsNode {
+func nodeFromConfig(ctx context.Context, cfg *config.Config) (*core.IpfsNode, error) {
 	if !logquiet {
 		fmt.Printf("Creating node with id: '%s'\n", cfg.Identity.PeerID)
 	}
 
-	node, err := core.NewIPFSNode(ctx, core.Online(cfg))
-	if err != nil {
-		panic(err)
-	}
-
-	return node
+	return core.NewIPFSNode(ctx, core.Online(cfg))
 }
 
 // Parses a range of the form: "[x-y]"
@@ -100,12 +178,18 @@ func ParseRange(s string) ([]int, error) {
 	}
 }
 
-func BuildConfig(addr string) *config.Config {
+// BuildConfig builds the config for the node with the given index, with
+// an identity derived from identitySeed if it is set
+func BuildConfig(i int, addr string) *config.Config {
 	cfg := new(config.Config)
 	cfg.Addresses.Swarm = []string{addr}
 	cfg.Datastore.Type = "memory"
 
-	id, priv, err := GenIdentity()
+	r := u.NewTimeSeededRand()
+	if identitySeed != 0 {
+		r = u.NewSeededRand(identitySeed + int64(i))
+	}
+	id, priv, err := GenIdentity(r)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	u "github.com/jbenet/go-ipfs/util"
+)
+
+func TestGenIdentityIsSeeded(t *testing.T) {
+	id1, priv1, err := GenIdentity(u.NewSeededRand(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, priv2, err := GenIdentity(u.NewSeededRand(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id1 != id2 || priv1 != priv2 {
+		t.Error("the same seed gave different identities")
+	}
+
+	id3, _, err := GenIdentity(u.NewSeededRand(43))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id3 == id1 {
+		t.Error("different seeds gave the same identity")
+	}
+}
+
+func TestSeededRSAKeyIsValid(t *testing.T) {
+	sk, err := seededRSAKey(u.NewSeededRand(42), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sk.Validate(); err != nil {
+		t.Error(err)
+	}
+	if sk.N.BitLen() != 512 {
+		t.Errorf("%d bit key", sk.N.BitLen())
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+	"syscall"
+)
+
+// Exit statuses of a run
+const (
+	ExitOK          = 0
+	ExitFailed      = 1 // an expectation failed
+	ExitError       = 2 // the harness itself failed, eg. a node wouldnt start
+	ExitPanic       = 3
+	ExitInterrupted = 130
+)
+
+var shutdownOnce sync.Once
+var shutdownLk sync.Mutex
+var shutdownHooks []func()
+
+// cancels masterCtx, set once the nodes are being built
+var cancelMaster func()
+
+// OnShutdown registers a function to flush or close something when the
+// run ends, hooks are run in reverse order like defers
+func OnShutdown(f func()) {
+	shutdownLk.Lock()
+	shutdownHooks = append(shutdownHooks, f)
+	shutdownLk.Unlock()
+}
+
+// Shutdown is the only way a run ends: it closes every node, runs the
+// shutdown hooks, prints a summary of the run and exits with the given
+// status, or ExitFailed if an expectation failed along the way
+func Shutdown(code int) {
+	shutdownOnce.Do(func() {
+		if code == ExitOK && expectFailed {
+			code = ExitFailed
+		}
+
+		if cancelMaster != nil {
+			cancelMaster()
+		}
+		for _, c := range nodeControllers() {
+			if c != nil {
+				c.Shutdown()
+			}
+		}
+
+		shutdownLk.Lock()
+		hooks := shutdownHooks
+		shutdownLk.Unlock()
+		for i := len(hooks) - 1; i >= 0; i-- {
+			runHook(hooks[i])
+		}
+
+		PrintSummary(code)
+		os.Exit(code)
+	})
+}
+
+// runHook runs a shutdown hook, making sure one broken hook doesnt stop
+// the rest from flushing
+func runHook(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Panic in shutdown hook: %s\n", r)
+		}
+	}()
+	f()
+}
+
+// HandleSignals shuts down cleanly when the user hits ctrl-c
+func HandleSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		fmt.Printf("\nReceived %s, shutting down.\n", sig)
+		Shutdown(ExitInterrupted)
+	}()
+}
+
+// RecoverPanic is deferred at the top of every goroutine that runs node
+// code, so a panicking node still goes through Shutdown
+func RecoverPanic() {
+	if r := recover(); r != nil {
+		fmt.Printf("Panic: %s\n%s", r, debug.Stack())
+		Shutdown(ExitPanic)
+	}
+}
+
+// PrintSummary prints the outcome of the run
+func PrintSummary(code int) {
+	assertlk.Lock()
+	passed, failed := 0, 0
+	for _, tc := range assertions {
+		if tc.Failure != nil {
+			failed++
+		} else {
+			passed++
+		}
+	}
+	assertlk.Unlock()
+
+	rslock.Lock()
+	errored := 0
+	for _, r := range allResults {
+		if !r.Success {
+			errored++
+		}
+	}
+	ncmds := len(allResults)
+	rslock.Unlock()
+
+	fmt.Printf("Run summary: %d expectations passed, %d failed; %d of %d commands returned errors.\n",
+		passed, failed, errored, ncmds)
+
+	switch code {
+	case ExitOK:
+		fmt.Println("Run finished successfully.")
+	case ExitFailed:
+		fmt.Println("Run failed: an expectation did not hold.")
+	case ExitError:
+		fmt.Println("Run aborted: harness error.")
+	case ExitPanic:
+		fmt.Println("Run aborted: panic.")
+	case ExitInterrupted:
+		fmt.Println("Run interrupted.")
+	}
+}
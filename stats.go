@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// upper bounds of the latency histogram buckets, anything slower lands
+// in a final overflow bucket
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	time.Millisecond * 2,
+	time.Millisecond * 5,
+	time.Millisecond * 10,
+	time.Millisecond * 20,
+	time.Millisecond * 50,
+	time.Millisecond * 100,
+	time.Millisecond * 200,
+	time.Millisecond * 500,
+	time.Second,
+	time.Second * 2,
+	time.Second * 5,
+	time.Second * 10,
+}
+
+// named groups of nodes to break statistics down by, set with the
+// 'group' setup line
+var nodeGroups = make(map[string][]int)
+
+// every result recorded this run
+var allResults []*Result
+
+// LatencySummary describes the latency distribution of a set of results
+type LatencySummary struct {
+	Count     int           `json:"count"`
+	Successes int           `json:"successes"`
+	P50       time.Duration `json:"p50"`
+	P90       time.Duration `json:"p90"`
+	P99       time.Duration `json:"p99"`
+	Max       time.Duration `json:"max"`
+	Buckets   []int         `json:"buckets"`
+}
+
+// SuccessRate returns the fraction of results that succeeded
+func (ls *LatencySummary) SuccessRate() float64 {
+	if ls.Count == 0 {
+		return 0
+	}
+	return float64(ls.Successes) / float64(ls.Count)
+}
+
+// Summarize builds a latency summary of the given results, failed
+// operations count towards the latencies as well
+func Summarize(rs []*Result) *LatencySummary {
+	ls := &LatencySummary{Buckets: make([]int, len(latencyBuckets)+1)}
+	durs := make([]time.Duration, 0, len(rs))
+	for _, r := range rs {
+		ls.Count++
+		if r.Success {
+			ls.Successes++
+		}
+		durs = append(durs, r.Duration)
+		ls.Buckets[bucketFor(r.Duration)]++
+	}
+	if len(durs) == 0 {
+		return ls
+	}
+
+	sort.Sort(durations(durs))
+	ls.P50 = percentile(durs, 0.50)
+	ls.P90 = percentile(durs, 0.90)
+	ls.P99 = percentile(durs, 0.99)
+	ls.Max = durs[len(durs)-1]
+	return ls
+}
+
+func bucketFor(d time.Duration) int {
+	for i, b := range latencyBuckets {
+		if d <= b {
+			return i
+		}
+	}
+	return len(latencyBuckets)
+}
+
+// percentile uses the nearest rank method on an already sorted list
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(p*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// ResultsByCommand splits results up by the command that was run
+func ResultsByCommand(rs []*Result) map[string][]*Result {
+	out := make(map[string][]*Result)
+	for _, r := range rs {
+		out[r.Command] = append(out[r.Command], r)
+	}
+	return out
+}
+
+func inGroup(idex int, group []int) bool {
+	for _, i := range group {
+		if i == idex {
+			return true
+		}
+	}
+	return false
+}
+
+// PrintStats writes latency summaries and histograms for every command
+// type, or just the given ones, broken down by node group
+func PrintStats(w io.Writer, only []string) {
+	rslock.Lock()
+	rs := make([]*Result, len(allResults))
+	copy(rs, allResults)
+	rslock.Unlock()
+
+	if len(rs) == 0 {
+		fmt.Fprintln(w, "No commands have been run yet.")
+		return
+	}
+
+	bycmd := ResultsByCommand(rs)
+	var cmds []string
+	for c := range bycmd {
+		if len(only) == 0 || containsString(only, c) {
+			cmds = append(cmds, c)
+		}
+	}
+	sort.Strings(cmds)
+
+	var groups []string
+	for g := range nodeGroups {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+
+	for _, c := range cmds {
+		ls := Summarize(bycmd[c])
+		fmt.Fprintf(w, "%s:\n", c)
+		printSummaryLine(w, "all", ls)
+		for _, g := range groups {
+			var grs []*Result
+			for _, r := range bycmd[c] {
+				if inGroup(r.Node, nodeGroups[g]) {
+					grs = append(grs, r)
+				}
+			}
+			if len(grs) > 0 {
+				printSummaryLine(w, g, Summarize(grs))
+			}
+		}
+		printHistogram(w, ls)
+	}
+
+	gslock.Lock()
+	trans := make([]transferInfo, len(globalStats.Transfers))
+	copy(trans, globalStats.Transfers)
+	gslock.Unlock()
+	if len(trans) > 0 {
+		speeds := make([]float64, 0, len(trans))
+		for _, t := range trans {
+			speeds = append(speeds, t.Speed)
+		}
+		sort.Float64s(speeds)
+		fmt.Fprintf(w, "transfers: %d, speed p50 %.0f B/s, p10 %.0f B/s, min %.0f B/s\n",
+			len(speeds), speeds[len(speeds)/2], speeds[len(speeds)/10], speeds[0])
+	}
+}
+
+func printSummaryLine(w io.Writer, group string, ls *LatencySummary) {
+	fmt.Fprintf(w, "\t%-10s %5d ops  %5.1f%% ok  p50 %-10s p90 %-10s p99 %-10s max %s\n",
+		group, ls.Count, ls.SuccessRate()*100, ls.P50, ls.P90, ls.P99, ls.Max)
+}
+
+func printHistogram(w io.Writer, ls *LatencySummary) {
+	max := 0
+	for _, c := range ls.Buckets {
+		if c > max {
+			max = c
+		}
+	}
+	if max == 0 {
+		return
+	}
+	for i, c := range ls.Buckets {
+		label := "> " + latencyBuckets[len(latencyBuckets)-1].String()
+		if i < len(latencyBuckets) {
+			label = "<= " + latencyBuckets[i].String()
+		}
+		bar := strings.Repeat("#", (c*40+max-1)/max)
+		fmt.Fprintf(w, "\t\t%8s |%s %d\n", label, bar, c)
+	}
+}
+
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	ms := time.Millisecond
+	var ten []time.Duration
+	for i := 1; i <= 10; i++ {
+		ten = append(ten, time.Duration(i)*ms)
+	}
+
+	tests := []struct {
+		sorted []time.Duration
+		p      float64
+		want   time.Duration
+	}{
+		{ten, 0, 1 * ms},
+		{ten, 0.5, 5 * ms},
+		{ten, 0.9, 9 * ms},
+		{ten, 0.99, 10 * ms},
+		{ten, 1, 10 * ms},
+		{[]time.Duration{3 * ms}, 0.5, 3 * ms},
+		{[]time.Duration{3 * ms}, 0.99, 3 * ms},
+		{[]time.Duration{1 * ms, 2 * ms}, 0.5, 1 * ms},
+		{[]time.Duration{1 * ms, 2 * ms}, 0.9, 2 * ms},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.sorted, tt.p); got != tt.want {
+			t.Errorf("percentile(%v, %g) = %s, want %s", tt.sorted, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	ms := time.Millisecond
+	var rs []*Result
+	// out of order, with the slowest one failing
+	for _, d := range []time.Duration{7, 3, 1, 9, 5, 2, 8, 4, 6, 10} {
+		rs = append(rs, &Result{Duration: d * ms, Success: d != 10})
+	}
+
+	ls := Summarize(rs)
+	if ls.Count != 10 || ls.Successes != 9 {
+		t.Fatalf("counted %d results, %d successes", ls.Count, ls.Successes)
+	}
+	if ls.P50 != 5*ms || ls.P90 != 9*ms || ls.P99 != 10*ms || ls.Max != 10*ms {
+		t.Errorf("p50 %s p90 %s p99 %s max %s", ls.P50, ls.P90, ls.P99, ls.Max)
+	}
+	if r := ls.SuccessRate(); r != 0.9 {
+		t.Errorf("success rate %g, want 0.9", r)
+	}
+
+	empty := Summarize(nil)
+	if empty.Count != 0 || empty.P50 != 0 || empty.SuccessRate() != 0 {
+		t.Errorf("summary of nothing: %+v", empty)
+	}
+}
+
+func TestRecordResultTrimsOutput(t *testing.T) {
+	defer func(rs []*Result) { allResults = rs }(allResults)
+	allResults = nil
+
+	long := strings.Repeat("x", 10*maxKeptOutput)
+	r := NewResult(-1, []string{"0", "get", "k"}, time.Now(), long, nil)
+	RecordResult(r)
+	if r.Output != long {
+		t.Error("the caller's result was changed")
+	}
+	if n := len(allResults[0].Output); n > maxKeptOutput+3 {
+		t.Errorf("kept %d bytes of output", n)
+	}
+}
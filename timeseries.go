@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/go.net/context"
+)
+
+// number of commands currently running on nodes
+var inflight int64
+
+// Sample is a snapshot of network wide gauges taken by the sampler
+type Sample struct {
+	Time     time.Time `json:"time"`
+	Alive    int       `json:"alive"`
+	Inflight int64     `json:"inflight"`
+
+	// bytes per second moved by the network since the previous sample
+	BwInRate  float64 `json:"bw_in_rate"`
+	BwOutRate float64 `json:"bw_out_rate"`
+
+	// connected peers of each node, indexed by node number, -1 for
+	// nodes that are not running. The dht doesnt expose its routing
+	// table, so there is no gauge for that.
+	Peers []int `json:"peers"`
+}
+
+// RunSampler writes a sample of the network as a line of json to the
+// given file every interval until the context is cancelled or the run
+// shuts down, which waits for the file to be closed
+func RunSampler(ctx context.Context, path string, interval time.Duration) error {
+	fi, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	OnShutdown(func() {
+		close(stop)
+		<-done
+	})
+
+	go func() {
+		defer close(done)
+		defer fi.Close()
+		enc := json.NewEncoder(fi)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+
+		last := networkStatistics()
+		lastTime := time.Now()
+		for {
+			select {
+			case now := <-tick.C:
+				s := TakeSample(now)
+				totals := networkStatistics()
+				secs := now.Sub(lastTime).Seconds()
+				s.BwInRate = rate(totals.BwIn, last.BwIn, secs)
+				s.BwOutRate = rate(totals.BwOut, last.BwOut, secs)
+				last, lastTime = totals, now
+
+				if err := enc.Encode(s); err != nil {
+					fmt.Printf("Error writing sample: %s\n", err)
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// TakeSample records the current gauges of every node
+func TakeSample(now time.Time) *Sample {
+	s := &Sample{
+		Time:     now,
+		Inflight: atomic.LoadInt64(&inflight),
+	}
+
+	cs := nodeControllers()
+	s.Peers = make([]int, len(cs))
+	for i, c := range cs {
+		if c == nil || !c.Alive() {
+			s.Peers[i] = -1
+			continue
+		}
+		s.Alive++
+		s.Peers[i] = c.NumPeers()
+	}
+	return s
+}
+
+// rate of change between two totals, which should only grow, treating
+// a drop as no change rather than wrapping around
+func rate(cur, prev uint64, secs float64) float64 {
+	if cur < prev || secs <= 0 {
+		return 0
+	}
+	return float64(cur-prev) / secs
+}
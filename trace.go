@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	notif "github.com/jbenet/go-ipfs/routing/notifications"
+)
+
+// directory lookup traces are written to
+var tracedir = "traces"
+
+// commands whose lookups can be traced
+var traceable = map[string]bool{
+	"get":      true,
+	"findpeer": true,
+	"findprov": true,
+}
+
+// TraceHop is a single query sent to a remote peer during a lookup
+type TraceHop struct {
+	Peer string `json:"peer"`
+
+	// Peer that told us about this one, empty if it came
+	// from our own routing table
+	Parent string `json:"parent,omitempty"`
+
+	Hop     int           `json:"hop"`
+	Sent    time.Time     `json:"sent"`
+	Latency time.Duration `json:"latency"`
+	Closer  []string      `json:"closer,omitempty"`
+	Error   string        `json:"error,omitempty"`
+
+	// whether this peer gave us the answer we were looking for
+	Answered bool `json:"answered,omitempty"`
+
+	done bool
+}
+
+// LookupTrace records the whole iterative query made by a get,
+// findpeer or findprov command
+type LookupTrace struct {
+	ID         int           `json:"id"`
+	Node       int           `json:"node"`
+	Command    string        `json:"command"`
+	Args       []string      `json:"args"`
+	Start      time.Time     `json:"start"`
+	Duration   time.Duration `json:"duration"`
+	Hops       []*TraceHop   `json:"hops"`
+	AnswerFrom []string      `json:"answer_from,omitempty"`
+	Error      string        `json:"error,omitempty"`
+
+	lk     sync.Mutex
+	byPeer map[string]*TraceHop
+	// peer -> peer that first returned it as a closer peer
+	found map[string]string
+}
+
+func NewTrace(node int, cmdparts []string) *LookupTrace {
+	return &LookupTrace{
+		Node:    node,
+		Command: strings.ToLower(cmdparts[1]),
+		Args:    cmdparts[2:],
+		Start:   time.Now(),
+		byPeer:  make(map[string]*TraceHop),
+		found:   make(map[string]string),
+	}
+}
+
+// WatchQueries returns a context that passes every dht query event of
+// whatever is run with it to the given func, until stop is called
+func WatchQueries(ctx context.Context, handle func(*notif.QueryEvent)) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	events := make(chan *notif.QueryEvent, 16)
+	ctx = notif.RegisterForQueryEvents(ctx, events)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case ev := <-events:
+				handle(ev)
+			case <-ctx.Done():
+				// pick up anything published before we were cancelled
+				for {
+					select {
+					case ev := <-events:
+						handle(ev)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return ctx, func() {
+		cancel()
+		<-done
+	}
+}
+
+// HandleEvent adds a dht query event to the trace
+func (tr *LookupTrace) HandleEvent(ev *notif.QueryEvent) {
+	tr.lk.Lock()
+	defer tr.lk.Unlock()
+
+	now := time.Now()
+	id := ev.ID.Pretty()
+	switch ev.Type {
+	case notif.SendingQuery:
+		hop := &TraceHop{
+			Peer:   id,
+			Parent: tr.found[id],
+			Hop:    1,
+			Sent:   now,
+		}
+		if parent, ok := tr.byPeer[hop.Parent]; ok {
+			hop.Hop = parent.Hop + 1
+		}
+		tr.byPeer[id] = hop
+		tr.Hops = append(tr.Hops, hop)
+	case notif.PeerResponse, notif.QueryError:
+		hop := tr.hopFor(id, now)
+		hop.Latency = now.Sub(hop.Sent)
+		hop.done = true
+		if ev.Type == notif.QueryError {
+			hop.Error = ev.Extra
+		}
+		for _, pi := range ev.Responses {
+			cp := pi.ID.Pretty()
+			hop.Closer = append(hop.Closer, cp)
+			if _, ok := tr.found[cp]; !ok {
+				tr.found[cp] = id
+			}
+		}
+	case notif.Value, notif.Provider, notif.FinalPeer:
+		// the peer that handed us the answer is the one we queried,
+		// which for a provider or final peer is not necessarily ev.ID
+		hop := tr.lastAnswering()
+		if hop != nil {
+			hop.Answered = true
+			tr.AnswerFrom = append(tr.AnswerFrom, hop.Peer)
+		} else {
+			tr.AnswerFrom = append(tr.AnswerFrom, id)
+		}
+	}
+}
+
+// hopFor returns the hop for the given peer, creating one if we missed
+// the event for sending the query
+func (tr *LookupTrace) hopFor(id string, now time.Time) *TraceHop {
+	hop, ok := tr.byPeer[id]
+	if !ok {
+		hop = &TraceHop{Peer: id, Parent: tr.found[id], Hop: 1, Sent: now}
+		tr.byPeer[id] = hop
+		tr.Hops = append(tr.Hops, hop)
+	}
+	return hop
+}
+
+// lastAnswering returns the most recent hop that got a response
+func (tr *LookupTrace) lastAnswering() *TraceHop {
+	var last *TraceHop
+	for _, h := range tr.Hops {
+		if h.done && h.Error == "" && (last == nil || h.Sent.Add(h.Latency).After(last.Sent.Add(last.Latency))) {
+			last = h
+		}
+	}
+	return last
+}
+
+// Finish records the outcome of the lookup, it must be called after
+// event collection has stopped
+func (tr *LookupTrace) Finish(err error) {
+	tr.lk.Lock()
+	defer tr.lk.Unlock()
+	tr.Duration = time.Since(tr.Start)
+	if err != nil {
+		tr.Error = err.Error()
+	}
+}
+
+// Save writes the trace as json into the given directory
+func (tr *LookupTrace) Save(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s-%d.json", tr.Node, tr.Command, tr.Start.UnixNano())
+	fi, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	tr.lk.Lock()
+	defer tr.lk.Unlock()
+	b, err := json.MarshalIndent(tr, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = fi.Write(b)
+	return err
+}
+
+// MaxHop returns the deepest hop reached by the lookup
+func (tr *LookupTrace) MaxHop() int {
+	max := 0
+	for _, h := range tr.Hops {
+		if h.Hop > max {
+			max = h.Hop
+		}
+	}
+	return max
+}
+
+// String prints the lookup as a tree, each peer nested under the
+// peer that returned it to us
+func (tr *LookupTrace) String() string {
+	tr.lk.Lock()
+	defer tr.lk.Unlock()
+
+	out := new(bytes.Buffer)
+	fmt.Fprintf(out, "Lookup trace: node %d %s %s (%s, %d queries, %d hops)\n",
+		tr.Node, tr.Command, strings.Join(tr.Args, " "), tr.Duration, len(tr.Hops), tr.MaxHop())
+
+	children := make(map[string][]*TraceHop)
+	for _, h := range tr.Hops {
+		parent := h.Parent
+		if _, ok := tr.byPeer[parent]; !ok {
+			parent = ""
+		}
+		children[parent] = append(children[parent], h)
+	}
+
+	// a peer queried more than once can show up under its own
+	// descendants, so each peer's children are only printed once
+	printed := make(map[string]bool)
+	var printHops func(parent string, depth int)
+	printHops = func(parent string, depth int) {
+		printed[parent] = true
+		for _, h := range children[parent] {
+			fmt.Fprintf(out, "%s%s [hop %d, %s] %d closer",
+				strings.Repeat("  ", depth), h.Peer, h.Hop, h.Latency, len(h.Closer))
+			switch {
+			case h.Error != "":
+				fmt.Fprintf(out, " error: %s", h.Error)
+			case !h.done:
+				fmt.Fprint(out, " (no response)")
+			}
+			if h.Answered {
+				fmt.Fprint(out, " <- answer")
+			}
+			if printed[h.Peer] {
+				fmt.Fprintln(out, " (seen above)")
+				continue
+			}
+			fmt.Fprintln(out)
+			printHops(h.Peer, depth+1)
+		}
+	}
+	printHops("", 1)
+
+	if tr.Error != "" {
+		fmt.Fprintf(out, "  lookup failed: %s\n", tr.Error)
+	}
+	return out.String()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTraceStringCycle(t *testing.T) {
+	tr := NewTrace(0, []string{"0", "get", "k"})
+	// b is queried again after c, which b told us about, returns it
+	hops := []*TraceHop{
+		{Peer: "a", Hop: 1},
+		{Peer: "b", Parent: "a", Hop: 2},
+		{Peer: "c", Parent: "b", Hop: 3},
+		{Peer: "b", Parent: "c", Hop: 4},
+	}
+	for _, h := range hops {
+		tr.Hops = append(tr.Hops, h)
+		tr.byPeer[h.Peer] = h
+	}
+
+	out := tr.String()
+	if n := strings.Count(out, "(seen above)"); n != 1 {
+		t.Errorf("%d repeated peers marked, want 1:\n%s", n, out)
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.net/context"
+	"github.com/jbenet/go-ipfs/core"
+	imp "github.com/jbenet/go-ipfs/importer"
+	chunk "github.com/jbenet/go-ipfs/importer/chunk"
+	mdag "github.com/jbenet/go-ipfs/merkledag"
+	ft "github.com/jbenet/go-ipfs/unixfs"
+	uio "github.com/jbenet/go-ipfs/unixfs/io"
+	u "github.com/jbenet/go-ipfs/util"
+)
+
+var trees = make(map[string]*TreeInfo)
+
+func getTree(name string) (*TreeInfo, bool) {
+	filesLk.RLock()
+	defer filesLk.RUnlock()
+	t, ok := trees[name]
+	return t, ok
+}
+
+func putTree(ti *TreeInfo) {
+	filesLk.Lock()
+	trees[ti.Name] = ti
+	filesLk.Unlock()
+}
+
+// TreeNode is a directory, a file, or with raw trees a single dag node
+type TreeNode struct {
+	Name     string
+	Dir      bool
+	Children []*TreeNode
+
+	// generated content isnt kept, but regenerated from Seed whenever
+	// it is needed
+	Seed int64
+	Size int64
+
+	// loaded content is held in Data, or with 'stream' read from Path
+	Data []byte
+	Path string
+}
+
+// TreeInfo is a generated directory tree or raw dag, moved around with
+// addtree and readtree
+type TreeInfo struct {
+	Name string
+
+	// raw trees are bare dag nodes holding Data and linking to their
+	// children, rather than unixfs directories and files
+	Raw bool
+
+	Root    *TreeNode
+	RootKey u.Key
+
+	// how the tree was made, and its totals. Gen is nil for loaded
+	// trees.
+	Spec  string
+	Gen   *GenSpec
+	Nodes int
+	Size  int64
+
+	// the chunker RootKey was added with, and the file chunks and
+	// total blocks of the dag it gave, with their keys
+	Chunker string
+	Chunks  int
+	Blocks  int
+	keys    []u.Key
+}
+
+// open returns a reader over the contents of a file in the tree
+func (ti *TreeInfo) open(tn *TreeNode) (io.ReadCloser, error) {
+	switch {
+	case tn.Path != "":
+		return os.Open(tn.Path)
+	case ti.Gen != nil:
+		r, err := ti.Gen.NewReader(tn.Seed)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(io.LimitReader(r, tn.Size)), nil
+	default:
+		return ioutil.NopCloser(bytes.NewReader(tn.Data)), nil
+	}
+}
+
+// data returns the contents of a block of a raw tree
+func (ti *TreeInfo) data(tn *TreeNode) ([]byte, error) {
+	if ti.Gen == nil {
+		return tn.Data, nil
+	}
+	return ti.Gen.Generate(tn.Seed, tn.Size)
+}
+
+// root returns RootKey, for callers not holding filesLk
+func (ti *TreeInfo) root() u.Key {
+	filesLk.RLock()
+	defer filesLk.RUnlock()
+	return ti.RootKey
+}
+
+// limits on the shape of a generated tree, so a typo cant ask for more
+// nodes than fit in memory
+const (
+	maxTreeDepth  = 1000
+	maxTreeFanout = 1 << 16
+	maxTreeNodes  = 1 << 20
+)
+
+// treeNodes counts the nodes of a tree of the given shape, stopping
+// once there are more than max
+func treeNodes(depth, fanout int, raw bool, max int64) int64 {
+	levels := depth
+	if !raw {
+		// the files below the deepest directories
+		levels++
+	}
+	total, level := int64(1), int64(1)
+	for i := 0; i < levels && total <= max; i++ {
+		level *= int64(fanout)
+		total += level
+	}
+	return total
+}
+
+// treeOpts are the key=value options of '@name make' for trees
+type treeOpts struct {
+	depth, fanout int
+	size          int64
+	gen           *GenSpec
+
+	// seed of the next file or block generated
+	seed int64
+}
+
+func parseTreeOpts(args []string, sizeKey string) (*treeOpts, error) {
+	to := &treeOpts{depth: 2, fanout: 4, size: 1024}
+	gs, err := ParseGenSpec(nil)
+	if err != nil {
+		return nil, err
+	}
+	to.gen = gs
+
+	for _, opt := range args {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("tree options are key=value, got '%s'", opt)
+		}
+		switch kv[0] {
+		case "depth":
+			to.depth, err = strconv.Atoi(kv[1])
+		case "fanout":
+			to.fanout, err = strconv.Atoi(kv[1])
+		case sizeKey:
+			to.size, err = ParseSize(kv[1])
+		case "gen":
+			to.gen, err = ParseGenSpec([]string{kv[1]})
+		default:
+			return nil, fmt.Errorf("unknown tree option '%s'", kv[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if to.depth < 0 || to.fanout < 0 {
+		return nil, errors.New("depth and fanout cant be negative")
+	}
+	if to.depth > maxTreeDepth || to.fanout > maxTreeFanout {
+		return nil, fmt.Errorf("depth can be at most %d and fanout at most %d", maxTreeDepth, maxTreeFanout)
+	}
+	return to, nil
+}
+
+// MakeTree generates a tree from the arguments following 'make':
+//
+//	depth=3 fanout=10 filesize=64KB [gen=text]
+//		directories nested depth deep, each holding fanout
+//		subdirectories, with fanout files in the deepest ones
+//	dag depth=1 fanout=1000 blocksize=1KB
+//		raw dag nodes of blocksize bytes, fanout children each,
+//		depth levels below the root. depth=1 with a large fanout
+//		is very wide, fanout=1 with a large depth very deep.
+func MakeTree(name string, args []string) (*TreeInfo, error) {
+	raw := len(args) > 0 && args[0] == "dag"
+	sizeKey := "filesize"
+	if raw {
+		args = args[1:]
+		sizeKey = "blocksize"
+	}
+	to, err := parseTreeOpts(args, sizeKey)
+	if err != nil {
+		return nil, err
+	}
+	nodes := treeNodes(to.depth, to.fanout, raw, maxTreeNodes)
+	if nodes > maxTreeNodes {
+		return nil, fmt.Errorf("tree would have over %d nodes", maxTreeNodes)
+	}
+	// raw blocks are all held in memory while the tree is added
+	if raw && to.size > maxMemorySize/nodes {
+		return nil, errTooLarge(nodes * to.size)
+	}
+	to.seed = fileSeed(name)
+
+	ti := &TreeInfo{Name: name, Raw: raw, Gen: to.gen}
+	if raw {
+		ti.Spec = fmt.Sprintf("dag depth=%d fanout=%d blocksize=%d", to.depth, to.fanout, to.size)
+	} else {
+		ti.Spec = fmt.Sprintf("depth=%d fanout=%d filesize=%d gen=%s", to.depth, to.fanout, to.size, to.gen.Type)
+	}
+	ti.Root, err = ti.generate(name, to, to.depth)
+	if err != nil {
+		return nil, err
+	}
+	return ti, nil
+}
+
+func (ti *TreeInfo) generate(name string, to *treeOpts, depth int) (*TreeNode, error) {
+	tn := &TreeNode{Name: name, Dir: !ti.Raw}
+	ti.Nodes++
+
+	if ti.Raw {
+		tn.Seed, tn.Size = to.seed, to.size
+		to.seed++
+		ti.Size += to.size
+		if depth == 0 {
+			return tn, nil
+		}
+	}
+
+	for i := 0; i < to.fanout; i++ {
+		var child *TreeNode
+		var err error
+		switch {
+		case ti.Raw || depth > 0:
+			child, err = ti.generate(fmt.Sprintf("%d", i), to, depth-1)
+		default:
+			child = &TreeNode{Name: fmt.Sprintf("file%d", i), Seed: to.seed, Size: to.size}
+			to.seed++
+			ti.Nodes++
+			ti.Size += to.size
+		}
+		if err != nil {
+			return nil, err
+		}
+		tn.Children = append(tn.Children, child)
+	}
+	return tn, nil
+}
+
+// build turns the tree into dag nodes, importing files with spl as it
+// goes. Files arent pinned on their own, the pin of the root covers
+// them, so unpinning the tree frees them too.
+func (ti *TreeInfo) build(n *core.IpfsNode, tn *TreeNode, spl chunk.BlockSplitter) (*mdag.Node, error) {
+	if !ti.Raw && !tn.Dir {
+		r, err := ti.open(tn)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return imp.BuildDagFromReader(r, n.DAG, nil, spl)
+	}
+
+	nd := &mdag.Node{}
+	if tn.Dir {
+		nd.Data = ft.FolderPBData()
+	} else {
+		data, err := ti.data(tn)
+		if err != nil {
+			return nil, err
+		}
+		nd.Data = data
+	}
+	for _, c := range tn.Children {
+		cnd, err := ti.build(n, c, spl)
+		if err != nil {
+			return nil, err
+		}
+		if err := nd.AddNodeLink(c.Name, cnd); err != nil {
+			return nil, err
+		}
+	}
+	return nd, nil
+}
+
+// fetchDag gets every node under nd, so the whole dag is local
+func fetchDag(ds mdag.DAGService, nd *mdag.Node) error {
+	for _, l := range nd.Links {
+		cnd, err := l.GetNode(ds)
+		if err != nil {
+			return err
+		}
+		if err := fetchDag(ds, cnd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify walks the dag under nd, checking it against the tree, and
+// returns the number of bytes of content read
+func (ti *TreeInfo) verify(n *core.IpfsNode, tn *TreeNode, nd *mdag.Node, path string) (int64, error) {
+	if !ti.Raw && !tn.Dir {
+		read, err := uio.NewDagReader(nd, n.DAG)
+		if err != nil {
+			return 0, err
+		}
+		orig, err := ti.open(tn)
+		if err != nil {
+			return 0, err
+		}
+		defer orig.Close()
+		size, err := compareContent(read, orig)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %s", path, err)
+		}
+		return size, nil
+	}
+
+	read := int64(0)
+	if ti.Raw {
+		data, err := ti.data(tn)
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(nd.Data, data) {
+			return 0, fmt.Errorf("%s: block data doesnt match", path)
+		}
+		read += int64(len(nd.Data))
+	}
+	if len(nd.Links) != len(tn.Children) {
+		return 0, fmt.Errorf("%s: has %d links, expected %d", path, len(nd.Links), len(tn.Children))
+	}
+	// links may come back in a different order, so match them by name
+	links := make(map[string]*mdag.Link)
+	for _, l := range nd.Links {
+		links[l.Name] = l
+	}
+	for _, c := range tn.Children {
+		cpath := path + "/" + c.Name
+		l, ok := links[c.Name]
+		if !ok {
+			return 0, fmt.Errorf("%s: no link", cpath)
+		}
+		cnd, err := l.GetNode(n.DAG)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %s", cpath, err)
+		}
+		cread, err := ti.verify(n, c, cnd, cpath)
+		if err != nil {
+			return 0, err
+		}
+		read += cread
+	}
+	return read, nil
+}
+
+func AddTree(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
+	if len(cmdparts) < 3 {
+		return fmt.Sprintln("addtree: '# addtree treeref [chunker=size-N|rabin-AVG[-MIN-MAX]]'"), ErrArgCount
+	}
+
+	ti, ok := getTree(cmdparts[2])
+	if !ok {
+		return fmt.Sprintf("No such tree: %s\n", cmdparts[2]), u.ErrNotFound
+	}
+	chunker, cs, err := parseAddOpts(cmdparts[3:])
+	if err != nil {
+		return "", err
+	}
+
+	nd, err := ti.build(n, ti.Root, cs)
+	if err != nil {
+		return "", err
+	}
+	if err := n.DAG.AddRecursive(nd); err != nil {
+		return "", err
+	}
+	if err := n.Pinning.Pin(nd, true); err != nil {
+		return "", err
+	}
+	if err := n.Pinning.Flush(); err != nil {
+		return "", err
+	}
+
+	k, err := nd.Key()
+	if err != nil {
+		return "", err
+	}
+	keys, err := dagKeys(nd)
+	if err != nil {
+		return "", err
+	}
+	blocks := len(keys)
+
+	// as with files, the tree is read back through its first add, or
+	// the latest add to chunk it differently
+	filesLk.Lock()
+	if ti.RootKey == "" || ti.Chunker != chunker {
+		ti.RootKey = k
+		ti.Chunker = chunker
+		ti.Chunks = cs.chunks
+		ti.Blocks = blocks
+		ti.keys = keys
+	}
+	filesLk.Unlock()
+	return fmt.Sprintf("Tree Added (%s): %d nodes, %d bytes, %d chunks, %d blocks\n", chunker, ti.Nodes, ti.Size, cs.chunks, blocks), nil
+}
+
+func ReadTree(ctx context.Context, n *core.IpfsNode, cmdparts []string) (string, error) {
+	if len(cmdparts) < 3 {
+		return fmt.Sprintln("readtree: '# readtree treeref'"), ErrArgCount
+	}
+
+	ti, ok := getTree(cmdparts[2])
+	if !ok {
+		return fmt.Sprintf("No such tree: %s\n", cmdparts[2]), u.ErrNotFound
+	}
+	root := ti.root()
+	if root == "" {
+		return "", errors.New("tree hasnt been added by anyone else")
+	}
+
+	// only fetching the dag is timed, checking it against the tree
+	// regenerates content and reads the now local blocks again
+	start := time.Now()
+	nd, err := n.DAG.Get(root)
+	if err != nil {
+		return "", err
+	}
+	if err := fetchDag(n.DAG, nd); err != nil {
+		return "", err
+	}
+	took := time.Since(start)
+
+	read, err := ti.verify(n, ti.Root, nd, ti.Name)
+	if err != nil {
+		return "", err
+	}
+	bps := float64(read) / took.Seconds()
+	gslock.Lock()
+	globalStats.Transfers = append(globalStats.Transfers, transferInfo{
+		Size:  int(read),
+		Time:  took.Nanoseconds(),
+		Speed: bps,
+	})
+	gslock.Unlock()
+
+	return fmt.Sprintf("Read Tree Succeeded: %d nodes verified, %f bytes per second\n", ti.Nodes, bps), nil
+}
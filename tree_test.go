@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"testing"
+)
+
+func TestMakeTreeRegenerates(t *testing.T) {
+	// names only give the same seeds under an identity seed
+	defer func(s int64) { identitySeed = s }(identitySeed)
+	identitySeed = 42
+
+	for _, args := range [][]string{
+		{"depth=1", "fanout=3", "filesize=4KB"},
+		{"dag", "depth=2", "fanout=2", "blocksize=1KB"},
+	} {
+		a, err := MakeTree("t", args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := MakeTree("t", args)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var check func(x, y *TreeNode)
+		check = func(x, y *TreeNode) {
+			if x.Data != nil {
+				t.Errorf("%v: %s holds its content", args, x.Name)
+			}
+			if !x.Dir {
+				xr, err := a.open(x)
+				if err != nil {
+					t.Fatal(err)
+				}
+				xd, _ := ioutil.ReadAll(xr)
+				yr, err := b.open(y)
+				if err != nil {
+					t.Fatal(err)
+				}
+				yd, _ := ioutil.ReadAll(yr)
+				if int64(len(xd)) != x.Size || !bytes.Equal(xd, yd) {
+					t.Errorf("%v: %s isnt regenerated the same", args, x.Name)
+				}
+			}
+			for i := range x.Children {
+				check(x.Children[i], y.Children[i])
+			}
+		}
+		check(a.Root, b.Root)
+	}
+}
+
+func TestTreeNodes(t *testing.T) {
+	tests := []struct {
+		depth, fanout int
+		raw           bool
+		want          int64
+	}{
+		{0, 4, false, 5},
+		{2, 4, false, 1 + 4 + 16 + 64},
+		{0, 4, true, 1},
+		{2, 3, true, 1 + 3 + 9},
+		{200, 1, true, 201},
+		{5, 0, false, 1},
+	}
+	for _, tt := range tests {
+		a, err := MakeTree("t", []string{"depth=" + strconv.Itoa(tt.depth), "fanout=" + strconv.Itoa(tt.fanout)})
+		if tt.raw {
+			a, err = MakeTree("t", []string{"dag", "depth=" + strconv.Itoa(tt.depth), "fanout=" + strconv.Itoa(tt.fanout)})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := treeNodes(tt.depth, tt.fanout, tt.raw, maxTreeNodes); got != tt.want || int64(a.Nodes) != tt.want {
+			t.Errorf("depth %d fanout %d raw %v: counted %d, made %d, want %d", tt.depth, tt.fanout, tt.raw, got, a.Nodes, tt.want)
+		}
+	}
+}
+
+func TestMakeTreeLimits(t *testing.T) {
+	for _, args := range [][]string{
+		{"depth=20", "fanout=10"},
+		{"dag", "depth=20", "fanout=10"},
+		{"depth=1001", "fanout=1"},
+		{"fanout=100000"},
+		{"dag", "depth=1", "fanout=2", "blocksize=1GB"},
+	} {
+		if _, err := MakeTree("t", args); err == nil {
+			t.Errorf("%v: made a tree", args)
+		}
+	}
+}
@@ -1,32 +1,154 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
 	"time"
-
-	"github.com/jbenet/go-ipfs/diagnostics"
 )
 
+// token the endpoints that control the run require, set with -token
+var controlToken string
+
+// listenAddr binds to loopback when no host is given, since the server
+// can run commands on the nodes
+func listenAddr(s string) string {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || host != "" {
+		return s
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// newToken makes a random control token for runs not given one
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authorized guards an endpoint that controls the run. The token must
+// come as a bearer token: pages on other sites cant set that header, so
+// they cant post commands through a visitor's browser, and unlike a
+// query parameter it stays out of logs and history.
+func authorized(fail func(http.ResponseWriter, int, string), h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || controlToken == "" {
+			fail(w, http.StatusUnauthorized, "missing token")
+			return
+		}
+		tok := strings.TrimPrefix(auth, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(controlToken)) != 1 {
+			fail(w, http.StatusUnauthorized, "bad or missing token")
+			return
+		}
+		h(w, r)
+	}
+}
+
 // Runs the visualization server to view d3 graph of the network
 func RunServer(s string) {
+	addr := listenAddr(s)
+	if controlToken == "" {
+		tok, err := newToken()
+		if err != nil {
+			fmt.Printf("Error making a control token, /cmd and the api are disabled: %s\n", err)
+		}
+		controlToken = tok
+	}
+	if controlToken != "" {
+		// the fragment never leaves the browser, the page reads the
+		// token from it
+		fmt.Printf("Control panel: http://%s/#token=%s\n", addr, controlToken)
+	}
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "index.html")
 	})
+	http.HandleFunc("/keyspace.html", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "keyspace.html")
+	})
+	http.HandleFunc("/keyspace", ServeKeyspace)
+	http.HandleFunc("/node.html", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "node.html")
+	})
+	http.HandleFunc("/node", ServeNode)
 	http.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
-		nd, ok := controllers[0].(*localNode)
-		if !ok {
-			fmt.Println("Invalid controller type!")
+		view, err := parseView(r.URL.Query().Get("view"))
+		if err != nil {
+			http.Error(w, "view must be a node index or 'all'", http.StatusBadRequest)
 			return
 		}
-		diag, err := nd.n.Diagnostics.GetDiagnostic(time.Second * 5)
-		if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(BuildGraph(view)); err != nil {
 			fmt.Println(err)
 		}
-		w.Write(diagnostics.GetGraphJson(diag))
 	})
-	err := http.ListenAndServe(s, nil)
+	http.HandleFunc("/metrics", ServeMetrics)
+	http.HandleFunc("/events", ServeEvents)
+	http.HandleFunc("/ops", ServeOps)
+	http.HandleFunc("/cmd", authorized(func(w http.ResponseWriter, code int, msg string) {
+		http.Error(w, msg, code)
+	}, ServeCommand))
+	http.HandleFunc(apiPrefix, authorized(func(w http.ResponseWriter, code int, msg string) {
+		apiFail(w, code, "%s", msg)
+	}, ServeAPI))
+	err := http.ListenAndServe(addr, nil)
 	if err != nil {
 		fmt.Println(err)
 	}
 }
+
+// ServeEvents streams every event of the run to the browser as
+// server-sent events, named after the event type
+func ServeEvents(w http.ResponseWriter, r *http.Request) {
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	events, unsub := SubscribeEvents()
+	defer unsub()
+
+	// without close notifications a gone client is noticed when writing
+	// to it fails, which the keepalives make sure happens even when the
+	// run is quiet
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	keepalive := time.NewTicker(time.Second * 15)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev := <-events:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, b); err != nil {
+				return
+			}
+			fl.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			fl.Flush()
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		in, addr string
+	}{
+		{":8080", "127.0.0.1:8080"},
+		{"localhost:8080", "localhost:8080"},
+		{"127.0.0.1:8080", "127.0.0.1:8080"},
+		{"[::1]:8080", "[::1]:8080"},
+		{"0.0.0.0:8080", "0.0.0.0:8080"},
+		{"10.0.0.5:8080", "10.0.0.5:8080"},
+	}
+	for _, tt := range tests {
+		if addr := listenAddr(tt.in); addr != tt.addr {
+			t.Errorf("listenAddr(%q) = %q, want %q", tt.in, addr, tt.addr)
+		}
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	defer func(tok string) { controlToken = tok }(controlToken)
+	fail := func(w http.ResponseWriter, code int, msg string) { http.Error(w, msg, code) }
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	tests := []struct {
+		token  string
+		url    string
+		header string
+		code   int
+	}{
+		{"", "/cmd", "", http.StatusUnauthorized},
+		{"", "/cmd", "Bearer ", http.StatusUnauthorized},
+		{"secret", "/cmd", "", http.StatusUnauthorized},
+		{"secret", "/cmd?token=secret", "", http.StatusUnauthorized},
+		{"secret", "/cmd", "Bearer secret", http.StatusOK},
+		{"secret", "/cmd", "Bearer secrets", http.StatusUnauthorized},
+		{"secret", "/cmd", "secret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		controlToken = tt.token
+		r := httptest.NewRequest("POST", tt.url, nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		authorized(fail, ok)(w, r)
+		if w.Code != tt.code {
+			t.Errorf("token %q %s %q: status %d, want %d", tt.token, tt.url, tt.header, w.Code, tt.code)
+		}
+	}
+}
+
+func TestProfilePath(t *testing.T) {
+	defer func(d string) { profiledir = d }(profiledir)
+	dir, err := ioutil.TempDir("", "dhthell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	profiledir = dir
+
+	tests := []struct {
+		name, path string
+		ok         bool
+	}{
+		{"churn", "churn.prof", true},
+		{"churn.out", "churn.out", true},
+		{"a/b", "a/b.prof", true},
+		{"a/../b", "b.prof", true},
+		{"/etc/passwd", "", false},
+		{"..", "", false},
+		{"../x", "", false},
+		{"a/../../x", "", false},
+	}
+	for _, tt := range tests {
+		path, err := profilePath(tt.name, ".prof")
+		if (err == nil) != tt.ok {
+			t.Errorf("profilePath(%q): error %v", tt.name, err)
+			continue
+		}
+		if err == nil && path != filepath.Join(dir, tt.path) {
+			t.Errorf("profilePath(%q) = %q, want %q", tt.name, path, filepath.Join(dir, tt.path))
+		}
+	}
+}